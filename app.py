@@ -6,6 +6,7 @@ import uuid
 from models import db, Session, Package
 import models
 from io import StringIO
+from datetime import datetime
 import csv
 
 logging.basicConfig()
@@ -37,8 +38,10 @@ def index():
                 # textareaのKB番号
                 kbnos = request.form['kbnos'].splitlines()
                 app.logger.info("kbnos={}".format(kbnos))
+                # パッケージの絞り込み条件(空の場合は全て)
+                pkg_filter = request.form.get('filter', '').strip() or None
                 for kbno in kbnos:
-                    db.session.add(Session(id=request.form['id'], kbno=int(kbno), sakey=request.form['sakey'], saname=request.form['saname'] ,status=models.STATUS_REGISTERED))
+                    db.session.add(Session(id=request.form['id'], kbno=int(kbno), sakey=request.form['sakey'], saname=request.form['saname'], filter=pkg_filter, status=models.STATUS_REGISTERED))
                 db.session.commit()
                 app.logger.info("create end")
                 del session['token']
@@ -46,7 +49,7 @@ def index():
                 # 入力エラー
                 db.session.rollback()
                 app.logger.info(e)
-                return render_template('index.html', id=request.form['id'], kbnos=request.form['kbnos'], valid="is-invalid", error=str(e))
+                return render_template('index.html', id=request.form['id'], kbnos=request.form['kbnos'], filter=request.form.get('filter'), valid="is-invalid", error=str(e))
             finally:
                 db.session.close()
 
@@ -61,23 +64,52 @@ def admin(uuid):
     app.logger.info("Get all session: sessions={}".format(session))
     return render_template('admin.html', session=session, id=uuid)
 
+# エラーになった KB の再試行(kbno がない場合はエラーになった全ての KB)
+# 再試行の日時を現在にすると、デーモンが次の周期で取得する(試行回数が上限に達している場合も再試行する)
+@app.route("/<uuid:uuid>/retry", methods=["POST"])
+def retry(uuid):
+    try:
+        now = datetime.utcnow()
+        query = db.session.query(Session).filter(Session.id == str(uuid), Session.status == models.STATUS_ERROR)
+        if request.form.get('kbno'):
+            query = query.filter(Session.kbno == int(request.form['kbno']))
+        for s in query.all():
+            app.logger.info("retry: id={}, kbno={}, attempt_count={}".format(s.id, s.kbno, s.attempt_count))
+            s.next_attempt_utc = now
+            db.session.query(Package).filter(Package.session_id == s.id, Package.kbno == s.kbno, Package.status == models.STATUS_ERROR).update({Package.next_attempt_utc: now})
+        db.session.commit()
+    except Exception as e:
+        db.session.rollback()
+        app.logger.info(e)
+    finally:
+        db.session.close()
+    return redirect(url_for('admin', uuid=uuid))
+
 # CSV のエクスポート
 @app.route("/<uuid:uuid>/export")
 def export(uuid):
     packages = db.session.query(Package).filter(Package.session_id == str(uuid)).all()
     app.logger.info("Get all session: sessions={}".format(session))
+    # KB の記事の情報(session テーブル)
+    kbs = {s.kbno: s for s in db.session.query(Session).filter(Session.id == str(uuid)).all()}
 
+    # excel=1 の場合は Excel で文字化けしないように BOM 付き、CRLF で出力
+    excel = request.args.get('excel') == '1'
     f = StringIO()
-    writer = csv.writer(f, quotechar='"', quoting=csv.QUOTE_ALL, lineterminator="\n")
+    if excel:
+        f.write('\ufeff')
+    writer = csv.writer(f, quotechar='"', quoting=csv.QUOTE_ALL, lineterminator="\r\n" if excel else "\n")
 
     #writer.writerow(['id','username','gender','age','created_at'])
     for p in packages:
-        writer.writerow([p.kbno, p.title, p.fileName, p.fileSize])
+        kb = kbs.get(p.kbno)
+        writer.writerow([p.kbno, kb.title if kb else None, kb.release_date if kb else None, kb.applies_to if kb else None, p.title, p.fileName, p.fileSize, p.products, p.classification, p.last_updated, p.version,
+            p.msrc_number, p.msrc_severity, p.reboot_behavior, p.requests_user_input, p.uninstallable, p.support_url, p.supersedes, p.superseded_by, p.filter_reason])
 
 
     res = make_response()
     res.data = f.getvalue()
-    res.headers['Content-Type'] = 'text/csv'
+    res.headers['Content-Type'] = 'text/csv; charset=utf-8'
     res.headers['Content-Disposition'] = 'attachment; filename='+ str(uuid) +'.csv'
     return res
 
@@ -94,7 +126,11 @@ def convert_status(s):
         models.STATUS_DOWNLOADSKIP : "Skip",
         models.STATUS_ERROR : "ERROR",
         models.STATUS_CLEANUP_COMPLETE : "Package file uploaded",
+        models.STATUS_FILTERED : "Filtered",
     }
+    # 中断した場合は中断した段階の状態と組み合わせて格納されている
+    if int(s) & models.STATUS_INTERRUPTED:
+        return status[int(s) & ~models.STATUS_INTERRUPTED] + " (interrupted)"
     return status[int(s)]
 
 if __name__ == "__main__":
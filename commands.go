@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tsubasaxZZZ/wutools/common"
+)
+
+// runSearch : search サブコマンド。検索語ごとにカタログの検索結果を一覧表示する(ファイルの情報は取得しない)
+func runSearch(args []string) int {
+	fs := newFlagSet("search", "<query>...", "Search the catalog by query(e.g. \"Cumulative Update for Windows Server 2016\") and list updates.\nOutput columns(tab separated): KB, UpdateID, Title, Products, Classification, LastUpdated, Size(bytes)")
+	filterOpt := fs.String("filter", "", "Specific filter of updates(product, classification and title can be used)")
+	catalog := addCatalogFlags(fs)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() == 0 {
+		return usageError(fs, "You need specific search query.")
+	}
+	filter, err := kb.ParseFilter(*filterOpt)
+	if err != nil {
+		return usageError(fs, "%v", err)
+	}
+	catalog.apply()
+
+	ctx := context.Background()
+	succeeded, failed := 0, 0
+	for _, query := range fs.Args() {
+		result, err := kb.DefaultCatalog.Search(ctx, query)
+		if err != nil {
+			log.Printf("Search error: query=[%s], error=[%v]", query, err)
+			failed++
+			continue
+		}
+		succeeded++
+		log.Printf("Search result: query=[%s], total=[%d], pages=[%d]", query, result.Total, result.Pages)
+		for _, p := range result.Packages {
+			if ok, _ := filter.Evaluate(p); !ok {
+				continue
+			}
+			fmt.Printf("%d\t%s\t%s\t%s\t%s\t%s\t%d\n", kb.KBNoFromTitle(p.Title), p.UpdateID, p.Title, p.Products, p.Classification, p.LastUpdated.Format("2006-01-02"), p.CatalogSize)
+		}
+	}
+	return exitStatus(succeeded, failed)
+}
+
+// runInfo : info サブコマンド。KB のパッケージとファイルの情報を表示する
+func runInfo(args []string) int {
+	fs := newFlagSet("info", "[KB NO]...", "Show metadata of KB(packages, files and details).")
+	target := addTargetFlags(fs)
+	supersOpt := fs.Bool("supersedence", false, "Show supersedence chain of KB to the latest update instead of files")
+	catalog := addCatalogFlags(fs)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	specs, opts, code, ok := target.parse(fs)
+	if !ok {
+		return code
+	}
+	catalog.apply()
+	ctx := context.Background()
+
+	if *supersOpt {
+		if len(target.queries) > 0 {
+			return usageError(fs, "Search query(-q) can not be specified with -supersedence.")
+		}
+		trees, errs := resolveSupersedence(ctx, specs, opts)
+		for _, tree := range trees {
+			printSupersedence(os.Stdout, tree)
+		}
+		return exitStatus(len(trees), len(errs))
+	}
+
+	kbList := target.buildList(ctx, specs, opts)
+	for _, result := range kbList.Results() {
+		if result.Err != nil {
+			fmt.Printf("KB%d %s: ERROR %v\n", result.No, result.Query, result.Err)
+			continue
+		}
+		printKB(os.Stdout, result.KB)
+	}
+	return exitStatus(len(kbList.KBs()), len(kbList.Results())-len(kbList.KBs()))
+}
+
+// printKB : KB の情報をインデントして表示する
+func printKB(w io.Writer, k *kb.KB) {
+	fmt.Fprintf(w, "KB%d (hits: %d)\n", k.No(), k.Hits())
+	if k.Article != nil {
+		fmt.Fprintf(w, "  Article: %s\n", k.Article.Title)
+		fmt.Fprintf(w, "    Released: %s, Applies to: %s\n", k.Article.ReleaseDate.Format("2006-01-02"), strings.Join(k.Article.AppliesTo, "; "))
+		fmt.Fprintf(w, "    URL: %s\n", k.Article.URL)
+	}
+	for _, p := range k.PackageInfos {
+		fmt.Fprintf(w, "  %s\n", p.Title)
+		fmt.Fprintf(w, "    UpdateID: %s, Products: %s, Classification: %s, LastUpdated: %s\n", p.UpdateID, p.Products, p.Classification, p.LastUpdated.Format("2006-01-02"))
+		if p.Details != nil {
+			fmt.Fprintf(w, "    MSRC: %s %s, Restart: %s, Uninstallable: %t, Support: %s\n",
+				p.Details.MSRCNumber, p.Details.MSRCSeverity, p.Details.RebootBehavior, p.Details.Uninstallable, p.Details.SupportURL)
+		}
+		for _, file := range p.Files {
+			fmt.Fprintf(w, "    %s (%s, %d bytes)\n", file.FileName, file.Architecture, file.FileSize)
+		}
+	}
+	for _, filtered := range k.Filtered {
+		fmt.Fprintf(w, "  [filtered] %s: %s\n", filtered.Package.Title, filtered.Reason)
+	}
+}
+
+// printSupersedence : 置き換え関係の木をインデントして表示する
+// 複数の更新プログラムから置き換えられる更新プログラムは、2回目以降は置き換え先を省略する
+func printSupersedence(w io.Writer, tree *kb.SupersedenceTree) {
+	fmt.Fprintf(w, "KB%d\n", tree.No)
+	latest := map[string]bool{}
+	for _, node := range tree.Leaves() {
+		latest[node.Package.UpdateID] = true
+	}
+	printed := map[string]bool{}
+	var walk func(node *kb.SupersedenceNode, depth int)
+	walk = func(node *kb.SupersedenceNode, depth int) {
+		mark := ""
+		if latest[node.Package.UpdateID] {
+			mark = " [latest]"
+		}
+		if printed[node.Package.UpdateID] && !node.IsLeaf() {
+			fmt.Fprintf(w, "%s%s%s (see above)\n", strings.Repeat("  ", depth+1), node.Package.Title, mark)
+			return
+		}
+		printed[node.Package.UpdateID] = true
+		fmt.Fprintf(w, "%s%s%s\n", strings.Repeat("  ", depth+1), node.Package.Title, mark)
+		for _, child := range node.SupersededBy {
+			walk(child, depth+1)
+		}
+	}
+	for _, root := range tree.Roots {
+		walk(root, 0)
+	}
+}
+
+// runDownload : download サブコマンド。KB のファイルをダウンロードし、メタデータを CSV に出力する
+func runDownload(args []string) int {
+	fs := newFlagSet("download", "[KB NO]...", "Download package files of KB to output directory(default: current directory).\nMetadata(including digests for verify command) is written to CSV.")
+	target := addTargetFlags(fs)
+	latestOpt := fs.Bool("latest", false, "Resolve supersedence chain of KB and download only the latest updates")
+	outDirOpt := fs.String("out-dir", ".", "Specific output directory of package files")
+	layoutOpt := fs.String("layout", kb.DefaultLayout, "Specific file layout under output directory(e.g. \"{kb}/{arch}/{filename}\", \"{product}/{kb}/{filename}\")\nFields: {kb}, {arch}, {lang}, {product}, {classification}, {updateid}, {filename}")
+	metadataOpt := fs.String("metadata", "metadata.csv", "Specific metadata CSV file to write(empty to skip). \"-\" for stdout")
+	csvOpts := addCSVFlags(fs)
+	summaryOpt := fs.String("summary", "", "Specific file to write JSON run summary(KB, package, downloaded path, size, digest and status of each file). \"-\" for stdout")
+	progressOpt := fs.Bool("progress", isTerminal(os.Stderr), "Show aggregate progress of downloads(files, bytes, throughput) on stderr. Enabled by default if stderr is terminal")
+	catalog := addCatalogFlags(fs)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	specs, opts, code, ok := target.parse(fs)
+	if !ok {
+		return code
+	}
+	exportOpts, err := csvOpts.options(kb.FormatCSV)
+	if err != nil {
+		return usageError(fs, "%v", err)
+	}
+	layout, err := kb.ParseLayout(*layoutOpt)
+	if err != nil {
+		return usageError(fs, "%v", err)
+	}
+	catalog.apply()
+	ctx := context.Background()
+	startedAt := time.Now()
+
+	var kbList *kb.KBList
+	failed := 0
+	if *latestOpt {
+		if len(target.queries) > 0 {
+			return usageError(fs, "Search query(-q) can not be specified with -latest.")
+		}
+		trees, errs := resolveSupersedence(ctx, specs, opts)
+		failed += len(errs)
+		kbList, _ = kb.LatestKBList(ctx, trees, opts)
+	} else {
+		kbList = target.buildList(ctx, specs, opts)
+	}
+
+	downloadOpts := kb.DownloadOptions{OutDir: *outDirOpt, Layout: layout}
+	var display *kb.ProgressDisplay
+	if *progressOpt {
+		downloadOpts.Progress = kb.NewProgress()
+		display = kb.NewProgressDisplay(downloadOpts.Progress, os.Stderr, "Download")
+		// ログは進捗の行を消してから出力する
+		log.SetOutput(display)
+		display.Start(500 * time.Millisecond)
+	}
+	err = kbList.DownloadAllKB(ctx, *target.con, downloadOpts)
+	if display != nil {
+		display.Stop()
+		log.SetOutput(os.Stderr)
+	}
+	if err != nil {
+		log.Printf("Some package could not be downloaded: %v", err)
+	}
+	// ダウンロード先のパスと状態も出力するため、ダウンロード後に出力する
+	if *metadataOpt != "" {
+		if err := writeOutput(*metadataOpt, func(w io.Writer) error { return kbList.ExportMetadataToCSV(ctx, w, exportOpts) }); err != nil {
+			log.Printf("Export metadata error: %v", err)
+			return exitFailure
+		}
+	}
+
+	// ファイル単位の結果
+	summary := kbList.Summary(startedAt)
+	summary.Failed += failed
+	summary.ExitCode = exitStatus(summary.Succeeded, summary.Failed)
+	log.Printf("Download result: succeeded=[%d], failed=[%d]", summary.Succeeded, summary.Failed)
+	if *summaryOpt != "" {
+		if err := writeOutput(*summaryOpt, summary.WriteJSON); err != nil {
+			log.Printf("Write summary error: %v", err)
+			return exitFailure
+		}
+	}
+	return summary.ExitCode
+}
+
+// runExport : export サブコマンド。KB のメタデータを出力する
+func runExport(args []string) int {
+	fs := newFlagSet("export", "[KB NO]...", "Export metadata of KB(one record per file).")
+	target := addTargetFlags(fs)
+	var output string
+	fs.StringVar(&output, "output", "", "Specific output file. \"-\" for stdout(default: metadata.<format> or supersedence.<format>)")
+	fs.StringVar(&output, "o", "", "Shorthand of -output")
+	formatOpt := fs.String("format", "csv", "Specific output format(csv, json, ndjson)")
+	supersOpt := fs.Bool("supersedence", false, "Export supersedence chain of KB to the latest update instead of metadata(-format csv or json)")
+	csvOpts := addCSVFlags(fs)
+	catalog := addCatalogFlags(fs)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	specs, opts, code, ok := target.parse(fs)
+	if !ok {
+		return code
+	}
+	format, err := kb.ParseExportFormat(*formatOpt)
+	if err != nil {
+		return usageError(fs, "%v", err)
+	}
+	exportOpts, err := csvOpts.options(format)
+	if err != nil {
+		return usageError(fs, "%v", err)
+	}
+	catalog.apply()
+	ctx := context.Background()
+
+	if *supersOpt {
+		var write func(w io.Writer, trees []*kb.SupersedenceTree) error
+		switch format {
+		case kb.FormatCSV:
+			write = kb.WriteSupersedenceCSV
+		case kb.FormatJSON:
+			write = kb.WriteSupersedenceJSON
+		default:
+			return usageError(fs, "format %s is not supported with -supersedence(csv, json)", format)
+		}
+		if len(target.queries) > 0 {
+			return usageError(fs, "Search query(-q) can not be specified with -supersedence.")
+		}
+		if output == "" {
+			output = "supersedence." + string(format)
+		}
+		trees, errs := resolveSupersedence(ctx, specs, opts)
+		if err := writeOutput(output, func(w io.Writer) error { return write(w, trees) }); err != nil {
+			log.Printf("Export supersedence error: %v", err)
+			return exitFailure
+		}
+		return exitStatus(len(trees), len(errs))
+	}
+
+	if output == "" {
+		output = "metadata." + string(format)
+	}
+	kbList := target.buildList(ctx, specs, opts)
+	if err := writeOutput(output, func(w io.Writer) error { return kbList.ExportMetadata(ctx, w, exportOpts) }); err != nil {
+		log.Printf("Export metadata error: %v", err)
+		return exitFailure
+	}
+	return exitStatus(len(kbList.KBs()), len(kbList.Results())-len(kbList.KBs()))
+}
+
+// resolveSupersedence : KB ごとに置き換え関係を解決する。解決できなかった KB のエラーを返す
+func resolveSupersedence(ctx context.Context, specs []kb.KBSpec, opts kb.BuildOptions) ([]*kb.SupersedenceTree, []error) {
+	errs := []error{}
+	trees := []*kb.SupersedenceTree{}
+	seen := map[int]bool{}
+	for _, spec := range specs {
+		if seen[spec.No] {
+			continue
+		}
+		seen[spec.No] = true
+		tree, err := kb.ResolveSupersedence(ctx, spec.No, opts)
+		if err != nil {
+			log.Printf("Supersedence could not be resolved: kb=[%d], error=[%v]", spec.No, err)
+			errs = append(errs, err)
+			continue
+		}
+		for _, leaf := range tree.Leaves() {
+			log.Printf("Latest update: kb=[%d], latest-kb=[%d], title=[%s]", spec.No, leaf.KBNo, leaf.Package.Title)
+		}
+		trees = append(trees, tree)
+	}
+	return trees, errs
+}
+
+// runVerify : verify サブコマンド。ダウンロード済みのファイルをメタデータの CSV のサイズとダイジェストで検証する
+// ディレクトリの下をファイル名で探すため、ダウンロード時の配置(-layout)によらず検証できる
+func runVerify(args []string) int {
+	fs := newFlagSet("verify", "[directory]", "Verify downloaded files under directory(default: current directory, including subdirectories) against sizes and digests recorded in metadata CSV.\nOutput: OK / MISSING / NG and file path.")
+	metadataOpt := fs.String("metadata", "metadata.csv", "Specific metadata CSV file written by download or export command")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() > 1 {
+		return usageError(fs, "verify takes only one directory")
+	}
+	dir := "."
+	if fs.NArg() == 1 {
+		dir = fs.Arg(0)
+	}
+
+	f, err := os.Open(*metadataOpt)
+	if err != nil {
+		log.Printf("Open metadata error: %v", err)
+		return exitFailure
+	}
+	defer f.Close()
+	files, err := kb.ReadPackageFilesFromMetadataCSV(f)
+	if err != nil {
+		log.Printf("Read metadata error: file=[%s], error=[%v]", *metadataOpt, err)
+		return exitFailure
+	}
+
+	// ファイル名ごとのパス(同じファイル名が複数の KB のディレクトリにある場合は全て検証する)
+	paths := map[string][]string{}
+	err = filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			paths[d.Name()] = append(paths[d.Name()], path)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Read directory error: dir=[%s], error=[%v]", dir, err)
+		return exitFailure
+	}
+
+	succeeded, failed := 0, 0
+	for _, file := range files {
+		found := paths[kb.SanitizeFileName(file.FileName)]
+		if len(found) == 0 {
+			failed++
+			fmt.Printf("MISSING\t%s\n", file.FileName)
+			continue
+		}
+		for _, path := range found {
+			if err := kb.VerifyFile(file, path); err != nil {
+				failed++
+				fmt.Printf("NG\t%s\t%v\n", path, err)
+				continue
+			}
+			succeeded++
+			fmt.Printf("OK\t%s\n", path)
+		}
+	}
+	log.Printf("Verify result: dir=[%s], ok=[%d], ng=[%d]", dir, succeeded, failed)
+	return exitStatus(succeeded, failed)
+}
@@ -0,0 +1,204 @@
+package kb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// DefaultSupportBaseURL : サポート技術情報(KB の記事)のサイトの URL
+const DefaultSupportBaseURL = "https://support.microsoft.com"
+
+// kbArticlePath : KB の記事のパス。サポートサイトが記事の URL にリダイレクトする
+const kbArticlePath = "/en-us/help/%d"
+
+// ErrNoArticle : KB の記事が存在しない(サポートサイトの検索ページなどにリダイレクトされた)
+var ErrNoArticle = errors.New("KB article not found")
+
+// KBArticle : サポート技術情報の KB の記事の情報
+type KBArticle struct {
+	Title string
+	// ReleaseDate : 公開日。取得できない場合はゼロ値
+	ReleaseDate time.Time
+	// AppliesTo : 適用対象の製品
+	AppliesTo []string
+	// URL : リダイレクト後の記事の URL
+	URL string
+}
+
+// ArticleClient : サポート技術情報へのアクセス
+type ArticleClient interface {
+	// Article : KB の記事の情報。記事が存在しない場合は ErrNotFound または ErrNoArticle を返す
+	Article(ctx context.Context, no int) (*KBArticle, error)
+}
+
+// HTTPArticleClient : HTTP でサポート技術情報にアクセスする ArticleClient
+type HTTPArticleClient struct {
+	// BaseURL : サポートサイトの URL(末尾の / なし)
+	BaseURL    string
+	HTTPClient *http.Client
+	// Retry : 再試行ポリシー。MaxAttempts が 0 の場合は DefaultRetryPolicy
+	Retry RetryPolicy
+}
+
+// NewArticleClient : サポート技術情報のクライアントを生成する。httpClient が nil の場合は http.DefaultClient
+func NewArticleClient(baseURL string, httpClient *http.Client) *HTTPArticleClient {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &HTTPArticleClient{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: httpClient,
+	}
+}
+
+// DefaultArticles : BuildKBInfo で使用するサポート技術情報(KB 単位でキャッシュする)
+var DefaultArticles ArticleClient = NewArticleCache(NewArticleClient(DefaultSupportBaseURL, nil))
+
+// Article : KB の記事を取得して、タイトル、公開日、適用対象を解析する
+func (c *HTTPArticleClient) Article(ctx context.Context, no int) (*KBArticle, error) {
+	policy := c.Retry
+	if policy.MaxAttempts == 0 {
+		policy = DefaultRetryPolicy
+	}
+	articleURL := c.BaseURL + fmt.Sprintf(kbArticlePath, no)
+	var finalURL string
+	doc, err := policy.requestDocument(ctx, c.HTTPClient, "article", articleURL, func() (*http.Request, error) {
+		return http.NewRequest("GET", articleURL, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if doc.Url != nil {
+		finalURL = doc.Url.String()
+	}
+	article := parseArticle(doc)
+	// 存在しない KB の場合は検索ページなどにリダイレクトされる
+	if article.Title == "" || !strings.Contains(strings.ToUpper(article.Title), fmt.Sprintf("KB%d", no)) {
+		return nil, fmt.Errorf("%w: kb=[%d], url=[%s], title=[%s]", ErrNoArticle, no, finalURL, article.Title)
+	}
+	article.URL = finalURL
+	log.Printf("Get KB article: kb=[%d], title=[%s], releaseDate=[%s], appliesTo=[%d]", no, article.Title, formatDate(article.ReleaseDate), len(article.AppliesTo))
+	return article, nil
+}
+
+// articleDateRegexp : タイトル先頭の公開日(May 8, 2018—KB4103723 ...)
+var articleDateRegexp = regexp.MustCompile(`^([A-Z][a-z]+ \d{1,2}, \d{4})\s*[—–-]`)
+
+// articleDateMetas : 公開日のメタタグ(タイトルに公開日がない記事)
+var articleDateMetas = []string{"lastPublishedDate", "ms.date", "article:published_time"}
+
+// parseArticle : 記事のページを解析する
+func parseArticle(doc *goquery.Document) *KBArticle {
+	article := &KBArticle{}
+	article.Title = normalizeText(doc.Find("h1").First().Text())
+	if article.Title == "" {
+		article.Title = normalizeText(strings.TrimSuffix(doc.Find("title").First().Text(), " - Microsoft Support"))
+	}
+
+	if m := articleDateRegexp.FindStringSubmatch(article.Title); m != nil {
+		if t, err := time.Parse("January 2, 2006", m[1]); err == nil {
+			article.ReleaseDate = t
+		}
+	}
+	for _, name := range articleDateMetas {
+		if !article.ReleaseDate.IsZero() {
+			break
+		}
+		v, ok := doc.Find(fmt.Sprintf(`meta[name="%s"], meta[property="%s"]`, name, name)).First().Attr("content")
+		if !ok {
+			continue
+		}
+		for _, layout := range []string{time.RFC3339, "2006-01-02", "01/02/2006"} {
+			if t, err := time.Parse(layout, strings.TrimSpace(v)); err == nil {
+				article.ReleaseDate = t
+				break
+			}
+		}
+	}
+
+	doc.Find(".appliesToItem").Each(func(_ int, s *goquery.Selection) {
+		if v := normalizeText(s.Text()); v != "" {
+			article.AppliesTo = append(article.AppliesTo, v)
+		}
+	})
+	return article
+}
+
+// ArticleCache : KB 単位で記事の情報をキャッシュする ArticleClient
+// 同じ KB への同時の呼び出しは1回の取得にまとめる。記事が存在しない結果もキャッシュし、それ以外のエラーはキャッシュしない
+type ArticleCache struct {
+	client  ArticleClient
+	mu      sync.Mutex
+	entries map[int]*articleEntry
+}
+
+type articleEntry struct {
+	done    chan struct{}
+	article *KBArticle
+	err     error
+}
+
+// NewArticleCache : client の結果をキャッシュする ArticleClient を生成する
+func NewArticleCache(client ArticleClient) *ArticleCache {
+	return &ArticleCache{client: client, entries: map[int]*articleEntry{}}
+}
+
+// Article : キャッシュ済みの場合はキャッシュを、それ以外は client から取得した記事を返す
+func (c *ArticleCache) Article(ctx context.Context, no int) (*KBArticle, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[no]
+	if !ok {
+		entry = &articleEntry{done: make(chan struct{})}
+		c.entries[no] = entry
+	}
+	c.mu.Unlock()
+
+	if ok {
+		select {
+		case <-entry.done:
+			return entry.article, entry.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	entry.article, entry.err = c.client.Article(ctx, no)
+	if entry.err != nil && !isArticleNotFound(entry.err) {
+		c.mu.Lock()
+		delete(c.entries, no)
+		c.mu.Unlock()
+	}
+	close(entry.done)
+	return entry.article, entry.err
+}
+
+// isArticleNotFound : 記事が存在しないエラーかどうか
+func isArticleNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound) || errors.Is(err, ErrNoArticle)
+}
+
+// fetchArticle : KB の記事の情報を取得する。取得できない場合はログに出力して nil を返す(KB の処理は続ける)
+func fetchArticle(ctx context.Context, no int) *KBArticle {
+	if no == 0 {
+		return nil
+	}
+	article, err := DefaultArticles.Article(ctx, no)
+	if err != nil {
+		if isArticleNotFound(err) {
+			log.Printf("KB article is not found. skip.. : kb=[%d]", no)
+		} else {
+			log.Printf("Get KB article error. skip.. : kb=[%d], error=[%v]", no, err)
+		}
+		return nil
+	}
+	return article
+}
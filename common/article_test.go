@@ -0,0 +1,177 @@
+package kb
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// TestArticle : リダイレクト後の記事のページからタイトル、公開日、適用対象を取得する
+func TestArticle(t *testing.T) {
+	srv, _ := newTestCatalog(t)
+	client := NewArticleClient(srv.URL+"/", srv.Client())
+
+	tests := []struct {
+		no   int
+		want KBArticle
+	}{
+		{
+			// 公開日はタイトルから
+			no: 4103723,
+			want: KBArticle{
+				Title:       "May 8, 2018—KB4103723 (OS Build 14393.2248)",
+				ReleaseDate: time.Date(2018, 5, 8, 0, 0, 0, 0, time.UTC),
+				AppliesTo:   []string{"Windows 10, version 1607, all editions", "Windows Server 2016", "Windows 10 Enterprise 2016 LTSB"},
+				URL:         srv.URL + "/en-us/topic/kb4103723",
+			},
+		},
+		{
+			// タイトルに公開日がない場合はメタタグから
+			no: 4093105,
+			want: KBArticle{
+				Title:       "KB4093105 (OS Build 16299.402)",
+				ReleaseDate: time.Date(2018, 4, 23, 0, 0, 0, 0, time.UTC),
+				AppliesTo:   []string{"Windows 10, version 1709, all editions"},
+				URL:         srv.URL + "/en-us/topic/kb4093105",
+			},
+		},
+	}
+	for _, tt := range tests {
+		got, err := client.Article(context.Background(), tt.no)
+		if err != nil {
+			t.Errorf("Article(%d) error = %v", tt.no, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("Article(%d) = %+v, want %+v", tt.no, *got, tt.want)
+		}
+	}
+}
+
+// TestArticleNotFound : 記事が存在しない KB は ErrNotFound(404)
+func TestArticleNotFound(t *testing.T) {
+	srv, _ := newTestCatalog(t)
+	client := NewArticleClient(srv.URL, srv.Client())
+
+	_, err := client.Article(context.Background(), 9999999)
+	if !errors.Is(err, ErrNotFound) || !isArticleNotFound(err) {
+		t.Errorf("Article error = %v, want %v", err, ErrNotFound)
+	}
+}
+
+// TestParseArticle : タイトル(h1、なければ title)、公開日(タイトル、メタタグ)、適用対象
+func TestParseArticle(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want KBArticle
+	}{
+		{
+			name: "title tag and published time",
+			html: `<head><title>KB5005565 (OS Build 19043.1237) - Microsoft Support</title><meta property="article:published_time" content="2021-09-14T10:00:00Z" /></head><body></body>`,
+			want: KBArticle{Title: "KB5005565 (OS Build 19043.1237)", ReleaseDate: time.Date(2021, 9, 14, 10, 0, 0, 0, time.UTC)},
+		},
+		{
+			name: "en dash date and us date meta",
+			html: `<head><meta name="lastPublishedDate" content="05/09/2018" /></head><body><h1> April 17, 2018 – KB4093105 </h1><div class="appliesToItem"> Windows 10 </div><div class="appliesToItem"> </div></body>`,
+			want: KBArticle{Title: "April 17, 2018 – KB4093105", ReleaseDate: time.Date(2018, 4, 17, 0, 0, 0, 0, time.UTC), AppliesTo: []string{"Windows 10"}},
+		},
+		{
+			name: "no date",
+			html: `<head><meta name="ms.date" content="unknown" /></head><body><h1>KB890830</h1></body>`,
+			want: KBArticle{Title: "KB890830"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := goquery.NewDocumentFromReader(strings.NewReader("<html>" + tt.html + "</html>"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := parseArticle(doc); !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("parseArticle = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeArticleClient : 呼び出し回数を数え、KB 番号ごとに決めたエラーを返す ArticleClient
+type fakeArticleClient struct {
+	mu    sync.Mutex
+	calls map[int]int
+	errs  map[int]error
+}
+
+func (c *fakeArticleClient) Article(ctx context.Context, no int) (*KBArticle, error) {
+	c.mu.Lock()
+	c.calls[no]++
+	err := c.errs[no]
+	c.mu.Unlock()
+	// 同時の呼び出しが重なるように少し待つ
+	time.Sleep(10 * time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	return &KBArticle{Title: "KB article"}, nil
+}
+
+// TestArticleCache : 同じ KB の同時の呼び出しは1回にまとめ、記事が存在しない結果はキャッシュし、それ以外のエラーはキャッシュしない
+func TestArticleCache(t *testing.T) {
+	client := &fakeArticleClient{calls: map[int]int{}, errs: map[int]error{
+		2: ErrNoArticle,
+		3: errors.New("temporary error"),
+	}}
+	cache := NewArticleCache(client)
+
+	for round := 0; round < 2; round++ {
+		wg := &sync.WaitGroup{}
+		for _, no := range []int{1, 1, 1, 2, 2, 3} {
+			wg.Add(1)
+			go func(no int) {
+				defer wg.Done()
+				article, err := cache.Article(context.Background(), no)
+				if (no == 1) != (err == nil && article != nil) {
+					t.Errorf("Article(%d) = (%v, %v)", no, article, err)
+				}
+			}(no)
+		}
+		wg.Wait()
+	}
+
+	// 3 は同時の呼び出しはまとめるが、失敗した結果は次の呼び出しで取得し直す
+	want := map[int]int{1: 1, 2: 1, 3: 2}
+	if !reflect.DeepEqual(client.calls, want) {
+		t.Errorf("calls = %v, want %v", client.calls, want)
+	}
+}
+
+// TestNewKBListArticle : BuildOptions.Article を指定した場合のみ KB の記事を取得する。記事がなくても KB の処理は続ける
+func TestNewKBListArticle(t *testing.T) {
+	srv, _ := newTestCatalog(t)
+	articles := DefaultArticles
+	t.Cleanup(func() { DefaultArticles = articles })
+	DefaultArticles = NewArticleCache(NewArticleClient(srv.URL, srv.Client()))
+
+	list, err := NewKBList(context.Background(), []KBSpec{{No: 4103723}, {No: 4093105}}, 2, BuildOptions{Article: true})
+	if err != nil {
+		t.Fatalf("NewKBList error = %v", err)
+	}
+	kbs := list.KBs()
+	if kbs[0].Title() != "May 8, 2018—KB4103723 (OS Build 14393.2248)" || kbs[1].Title() != "KB4093105 (OS Build 16299.402)" {
+		t.Errorf("Title() = [%q %q]", kbs[0].Title(), kbs[1].Title())
+	}
+
+	list, err = NewKBList(context.Background(), []KBSpec{{No: 4103723}}, 2, BuildOptions{})
+	if err != nil {
+		t.Fatalf("NewKBList error = %v", err)
+	}
+	if kb := list.KBs()[0]; kb.Article != nil || kb.Title() != "" {
+		t.Errorf("Article = %+v, want nil", kb.Article)
+	}
+}
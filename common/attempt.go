@@ -0,0 +1,124 @@
+package kb
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// SessionRetryPolicy : デーモンがエラーになったセッションを再試行するポリシー
+// 試行回数はセッション単位(session.attempt_count)で数え、MaxAttempts に達した場合は自動では再試行しない
+var SessionRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   1 * time.Minute,
+	MaxDelay:    1 * time.Hour,
+}
+
+// RetryCondition : 再試行の日時になったエラーのセッションの条件(session テーブルの WHERE 句。引数は StatusError)
+const RetryCondition = "status = ? AND next_attempt_utc IS NOT NULL AND next_attempt_utc <= UTC_TIMESTAMP() AND (lease_expires_utc IS NULL OR lease_expires_utc < UTC_TIMESTAMP())"
+
+// IsPermanent : 再試行しても成功しないエラー(KB がカタログに存在しない、絞り込み条件の誤り)かどうか
+// 複数のエラーをまとめたものは、全てが再試行しても成功しないエラーの場合のみ true
+func IsPermanent(err error) bool {
+	if err == nil {
+		return false
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range joined.Unwrap() {
+			if !IsPermanent(e) {
+				return false
+			}
+		}
+		return true
+	}
+	return errors.Is(err, ErrNotFound) || errors.Is(err, ErrNoCatalogHits) || errors.Is(err, ErrInvalidFilter)
+}
+
+// ClaimRetry : 再試行の日時になったエラーのセッションを、再試行するために取得する。試行回数を加算する
+// メタデータを取得済みの場合はダウンロードから(完了したファイルはやり直さない)、それ以外はメタデータの取得から再試行する
+func (session *Session) ClaimRetry(workerID string, lease time.Duration) (bool, error) {
+	var packages int
+	if err := session.Db.QueryRow("SELECT COUNT(*) FROM package WHERE session_id = ? AND kbno = ?", session.ID, session.Kbno).Scan(&packages); err != nil {
+		return false, err
+	}
+	toStatus := StatusMetadataInprogress
+	if packages > 0 {
+		toStatus = StautsMetadataComplete
+	}
+	claimed, err := session.claim(workerID, lease, toStatus, "attempt_count = attempt_count + 1, next_attempt_utc = NULL, ", RetryCondition, StatusError)
+	if claimed {
+		session.Attempts++
+	}
+	return claimed, err
+}
+
+// RecordAttempt : セッションの処理の結果(エラー、次の再試行の日時)を session テーブルに記録する
+// 成功した場合はエラーと再試行の日時を消す。中断した場合は試行の失敗として扱わない
+// 再試行しても成功しないエラー、または試行回数が policy.MaxAttempts に達した場合は再試行の日時を設定しない
+// エラーになったファイル(package テーブル)にも同じ再試行の日時を設定する
+func (session *Session) RecordAttempt(err error, policy RetryPolicy) {
+	if errors.Is(err, ErrInterrupted) || errors.Is(err, ErrLeaseLost) {
+		return
+	}
+	if err == nil {
+		_, err := session.Db.Exec(
+			"UPDATE session SET last_error = NULL, next_attempt_utc = NULL WHERE id = ? AND kbno = ?",
+			session.ID, session.Kbno,
+		)
+		if err != nil {
+			log.Printf("UPDATE ERROR: id=[%s], kbno=[%d], error=[%v]", session.ID.String, session.Kbno, err)
+		}
+		return
+	}
+
+	if IsPermanent(err) || session.Attempts >= policy.MaxAttempts {
+		log.Printf("Session failed. not retry.. : id=[%s], kbno=[%d], attempt=[%d/%d], permanent=[%t], error=[%v]",
+			session.ID.String, session.Kbno, session.Attempts, policy.MaxAttempts, IsPermanent(err), err)
+		session.updateAttempt("NULL", err)
+		return
+	}
+	delay := policy.backoff(session.Attempts, err)
+	log.Printf("Session failed. retry later.. : id=[%s], kbno=[%d], attempt=[%d/%d], delay=[%s], error=[%v]",
+		session.ID.String, session.Kbno, session.Attempts, policy.MaxAttempts, delay, err)
+	session.updateAttempt("DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? SECOND)", err, int(delay.Seconds()))
+}
+
+// updateAttempt : セッションとエラーになったファイルのエラー、再試行の日時(next の式)を更新する
+func (session *Session) updateAttempt(next string, err error, args ...interface{}) {
+	_, uerr := session.Db.Exec(
+		"UPDATE session SET last_error = ?, next_attempt_utc = "+next+" WHERE id = ? AND kbno = ?",
+		append(append([]interface{}{err.Error()}, args...), session.ID, session.Kbno)...,
+	)
+	if uerr != nil {
+		log.Printf("UPDATE ERROR: id=[%s], kbno=[%d], error=[%v]", session.ID.String, session.Kbno, uerr)
+	}
+	_, uerr = session.Db.Exec(
+		"UPDATE package SET next_attempt_utc = "+next+" WHERE session_id = ? AND kbno = ? AND status = ?",
+		append(args, session.ID, session.Kbno, StatusError)...,
+	)
+	if uerr != nil {
+		log.Printf("UPDATE ERROR: id=[%s], kbno=[%d], error=[%v]", session.ID.String, session.Kbno, uerr)
+	}
+}
+
+// startAttempt : ファイルの処理(ダウンロード・アップロード)の試行回数を加算する
+func (file *PackageFile) startAttempt(session Session, packageInfo *PackageInfo) {
+	_, err := session.Db.Exec(
+		"UPDATE package SET attempt_count = attempt_count + 1, next_attempt_utc = NULL WHERE session_id = ? AND kbno = ? AND title = ? AND fileName = ?",
+		session.ID, session.Kbno, packageInfo.Title, file.FileName,
+	)
+	if err != nil {
+		log.Printf("UPDATE ERROR: id=[%s], kbno=[%d], fileName=[%s], error=[%v]", session.ID.String, session.Kbno, file.FileName, err)
+	}
+}
+
+// recordError : ファイルの処理のエラーを記録する
+func (file *PackageFile) recordError(session Session, packageInfo *PackageInfo, err error) {
+	_, uerr := session.Db.Exec(
+		"UPDATE package SET last_error = ? WHERE session_id = ? AND kbno = ? AND title = ? AND fileName = ?",
+		err.Error(), session.ID, session.Kbno, packageInfo.Title, file.FileName,
+	)
+	if uerr != nil {
+		log.Printf("UPDATE ERROR: id=[%s], kbno=[%d], fileName=[%s], error=[%v]", session.ID.String, session.Kbno, file.FileName, uerr)
+	}
+}
@@ -0,0 +1,32 @@
+package kb
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// TestIsPermanent : 再試行しても成功しないエラー。まとめたエラーは全てが該当する場合のみ
+func TestIsPermanent(t *testing.T) {
+	temporary := &RequestError{Kind: ErrServer, Op: "search", URL: "https://catalog.example/Search.aspx", StatusCode: 503}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "not found", err: fmt.Errorf("kb=[%d]: %w", 4103723, ErrNotFound), want: true},
+		{name: "no catalog hits", err: fmt.Errorf("kb=[%d]: %w", 9999999, ErrNoCatalogHits), want: true},
+		{name: "invalid filter", err: fmt.Errorf("%w: unknown field", ErrInvalidFilter), want: true},
+		{name: "not found response", err: &RequestError{Kind: ErrNotFound, Op: "download", URL: "https://catalog.example/f.msu", StatusCode: 404}, want: true},
+		{name: "server error", err: temporary, want: false},
+		{name: "other", err: errors.New("connection reset"), want: false},
+		{name: "joined permanent", err: errors.Join(ErrNoCatalogHits, ErrNotFound), want: true},
+		{name: "joined with temporary", err: errors.Join(ErrNoCatalogHits, temporary), want: false},
+	}
+	for _, tt := range tests {
+		if got := IsPermanent(tt.err); got != tt.want {
+			t.Errorf("IsPermanent(%s) = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
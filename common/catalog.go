@@ -0,0 +1,431 @@
+package kb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// DefaultCatalogBaseURL : Windows Update カタログの URL
+const DefaultCatalogBaseURL = "https://www.catalog.update.microsoft.com"
+
+// CatalogClient : Windows Update カタログへのアクセス
+type CatalogClient interface {
+	// Search : 検索結果の全てのページの更新プログラムの一覧。ファイルの情報は含まない。該当なしの場合は空の一覧
+	Search(ctx context.Context, query string) (*SearchResult, error)
+	// PackageFiles : 更新プログラムを構成するファイルの一覧(DownloadDialog)
+	PackageFiles(ctx context.Context, updateID string) ([]*PackageFile, error)
+	// Details : 更新プログラムの詳細ページ(ScopedViewInline)の情報
+	Details(ctx context.Context, updateID string) (*UpdateDetails, error)
+	// Download : ファイルの offset バイト目以降のダウンロードを開始する。ステータスコードの確認は呼び出し元で行う
+	// 呼び出し元は cancel を呼び出してレスポンスを閉じること
+	Download(ctx context.Context, link string, offset int64) (resp *http.Response, cancel context.CancelFunc, err error)
+}
+
+// SearchResult : カタログの検索結果
+type SearchResult struct {
+	// Total : カタログが報告する検索結果の総件数
+	Total int
+	// Pages : 取得したページ数
+	Pages    int
+	Packages []*PackageInfo
+}
+
+// HTTPCatalogClient : HTTP で Windows Update カタログにアクセスする CatalogClient
+type HTTPCatalogClient struct {
+	// BaseURL : カタログの URL(末尾の / なし)
+	BaseURL string
+	// HTTPClient : カタログへのリクエスト、ファイルのダウンロードに使用するクライアント
+	HTTPClient *http.Client
+	// Retry : 再試行ポリシー。MaxAttempts が 0 の場合は DefaultRetryPolicy
+	Retry RetryPolicy
+}
+
+// DefaultCatalog : BuildKBInfo やダウンロードで使用するカタログ
+var DefaultCatalog CatalogClient = NewCatalogClient(DefaultCatalogBaseURL, nil)
+
+// NewCatalogClient : カタログのクライアントを生成する。httpClient が nil の場合は http.DefaultClient
+func NewCatalogClient(baseURL string, httpClient *http.Client) *HTTPCatalogClient {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &HTTPCatalogClient{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: httpClient,
+	}
+}
+
+func (c *HTTPCatalogClient) retry() RetryPolicy {
+	if c.Retry.MaxAttempts == 0 {
+		return DefaultRetryPolicy
+	}
+	return c.Retry
+}
+
+// catalogRetryPolicy : DefaultCatalog の再試行ポリシー。ファイルのダウンロードの再試行に使用する
+// HTTPCatalogClient 以外の場合は DefaultRetryPolicy
+func catalogRetryPolicy() RetryPolicy {
+	if c, ok := DefaultCatalog.(*HTTPCatalogClient); ok {
+		return c.retry()
+	}
+	return DefaultRetryPolicy
+}
+
+// maxSearchPages : 検索結果のページを辿る上限。カタログは 1ページ 25件、最大 1000件(40ページ)まで
+const maxSearchPages = 100
+
+// searchNextPageID : 検索結果の次のページへのリンク
+const searchNextPageID = "ctl00_catalogBody_nextPageLinkText"
+
+// searchDurationRegexp : 検索結果の件数表示
+// Updates: 1 - 25 of 436 (page 1 of 18)
+var searchDurationRegexp = regexp.MustCompile(`of (\d+) \(page (\d+) of (\d+)\)`)
+
+// doPostBackRegexp : ASP.NET のポストバックのリンク
+// 第1引数が __EVENTTARGET、第2引数が __EVENTARGUMENT
+//
+//	javascript:__doPostBack('ctl00$catalogBody$nextPageLinkText','')
+var doPostBackRegexp = regexp.MustCompile(`__doPostBack\('([^']*)','([^']*)'\)`)
+
+// Search : 検索結果の更新プログラムの一覧
+// 1ページに収まらない場合は、ポストバック(__VIEWSTATE / __EVENTTARGET)で次のページを順に取得する
+func (c *HTTPCatalogClient) Search(ctx context.Context, query string) (*SearchResult, error) {
+	searchURL := fmt.Sprintf("%s/Search.aspx?q=%s", c.BaseURL, url.QueryEscape(query))
+	catalogDoc, err := c.fetchDocument(ctx, "search", searchURL)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &SearchResult{Packages: []*PackageInfo{}}
+	seen := map[string]bool{}
+	pageURL := searchURL
+	for {
+		result.Pages++
+		for _, packageInfo := range parseSearchResults(catalogDoc) {
+			// ページの境界で同じ行が返ってきた場合は除外
+			if seen[packageInfo.UpdateID] {
+				continue
+			}
+			seen[packageInfo.UpdateID] = true
+			result.Packages = append(result.Packages, packageInfo)
+		}
+		total, page, pages, ok := parseSearchDuration(catalogDoc)
+		if ok {
+			result.Total = total
+		}
+		log.Printf("Get search result page: query=[%s], page=[%d/%d], packages=[%d], total=[%d]", query, page, pages, len(result.Packages), result.Total)
+
+		// 次のページ
+		form, actionURL, ok := nextPageForm(catalogDoc, pageURL)
+		if !ok || (pages > 0 && page >= pages) {
+			break
+		}
+		if result.Pages >= maxSearchPages {
+			log.Printf("Search result pages exceed the limit. stop.. : query=[%s], pages=[%d]", query, result.Pages)
+			break
+		}
+		pageURL = actionURL
+		catalogDoc, err = c.postForm(ctx, "search", actionURL, form)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if result.Total == 0 {
+		result.Total = len(result.Packages)
+	}
+	if len(result.Packages) != result.Total {
+		log.Printf("Number of packages does not match the total hit count: query=[%s], packages=[%d], total=[%d]", query, len(result.Packages), result.Total)
+	}
+	return result, nil
+}
+
+// parseSearchResults : 検索結果のページの更新プログラムの一覧
+func parseSearchResults(catalogDoc *goquery.Document) []*PackageInfo {
+	pkgs := []*PackageInfo{}
+	//抜き出してくる文字列:
+	//<a id="ef673d9c-0e61-412b-be87-9eba39fe13dd_link" href="javascript:void(0);" onclick="goToDetails(";ef673d9c-0e61-412b-be87-9eba39fe13dd");">
+	catalogDoc.Find("tbody > tr > td > a").Each(
+		func(_ int, s *goquery.Selection) {
+			onclick, ok := s.Attr("onclick")
+			if ok && strings.Contains(onclick, "goToDetails") {
+				// goToDetails の ID 部分だけ取得
+				updateID := strings.Replace(
+					strings.Replace(onclick, "goToDetails(\"", "", -1), "\");",
+					"",
+					-1,
+				)
+				packageInfo := &PackageInfo{
+					Title:    strings.TrimSpace(s.Text()),
+					UpdateID: updateID,
+				}
+				log.Printf("Get Package title and Id:packageTitle=[%s], onclick=[%s], updateID=[%s]", packageInfo.Title, onclick, updateID)
+				parseResultColumns(s.Closest("tr"), packageInfo)
+				pkgs = append(pkgs, packageInfo)
+			}
+		})
+	return pkgs
+}
+
+// parseSearchDuration : 検索結果の件数表示から総件数、現在のページ、ページ数を取得する
+func parseSearchDuration(catalogDoc *goquery.Document) (total int, page int, pages int, ok bool) {
+	m := searchDurationRegexp.FindStringSubmatch(catalogDoc.Find("#ctl00_catalogBody_searchDuration").Text())
+	if m == nil {
+		return 0, 0, 0, false
+	}
+	total, _ = strconv.Atoi(m[1])
+	page, _ = strconv.Atoi(m[2])
+	pages, _ = strconv.Atoi(m[3])
+	return total, page, pages, true
+}
+
+// nextPageForm : 次のページを取得するポストバックのフォームの値と送信先
+// 次のページへのリンクがない(最後のページ)場合は ok が false
+func nextPageForm(catalogDoc *goquery.Document, pageURL string) (form url.Values, actionURL string, ok bool) {
+	href, exists := catalogDoc.Find("#" + searchNextPageID).Attr("href")
+	if !exists {
+		return nil, "", false
+	}
+	m := doPostBackRegexp.FindStringSubmatch(href)
+	if m == nil {
+		return nil, "", false
+	}
+	aspnetForm := catalogDoc.Find("form#aspnetForm")
+	if aspnetForm.Length() == 0 {
+		aspnetForm = catalogDoc.Find("form").First()
+	}
+	// hidden の値(__VIEWSTATE, __EVENTVALIDATION など)をそのまま送り返す
+	form = url.Values{}
+	aspnetForm.Find("input[type='hidden']").Each(func(_ int, s *goquery.Selection) {
+		if name, ok := s.Attr("name"); ok {
+			form.Set(name, s.AttrOr("value", ""))
+		}
+	})
+	form.Set("__EVENTTARGET", m[1])
+	form.Set("__EVENTARGUMENT", m[2])
+
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return nil, "", false
+	}
+	action, err := base.Parse(aspnetForm.AttrOr("action", ""))
+	if err != nil {
+		return nil, "", false
+	}
+	return form, action.String(), true
+}
+
+// 検索結果の列
+// | (アイコン) | Title | Products | Classification | Last Updated | Version | Size | (Download) |
+const (
+	columnProducts       = 2
+	columnClassification = 3
+	columnLastUpdated    = 4
+	columnVersion        = 5
+	columnSize           = 6
+)
+
+// lastUpdatedLayout : 検索結果の Last Updated 列の書式(5/8/2018)
+const lastUpdatedLayout = "1/2/2006"
+
+// parseResultColumns : 検索結果の行から Products, Classification, Last Updated, Version, Size 列を読み取る
+func parseResultColumns(row *goquery.Selection, packageInfo *PackageInfo) {
+	cells := row.Children().Filter("td")
+	text := func(i int) string {
+		return normalizeText(cells.Eq(i).Text())
+	}
+	packageInfo.Products = text(columnProducts)
+	packageInfo.Classification = text(columnClassification)
+	if t, err := time.Parse(lastUpdatedLayout, text(columnLastUpdated)); err == nil {
+		packageInfo.LastUpdated = t
+	} else {
+		log.Printf("Last updated couldn't parse: updateID=[%s], value=[%s]", packageInfo.UpdateID, text(columnLastUpdated))
+	}
+	packageInfo.Version = text(columnVersion)
+	// 表示用のサイズ(64 KB)とは別に、バイト数が非表示の span に入っている
+	sizeCell := cells.Eq(columnSize)
+	if size, err := strconv.ParseInt(strings.TrimSpace(sizeCell.Find("span[id$='_originalSize']").Text()), 10, 64); err == nil {
+		packageInfo.CatalogSize = size
+	}
+	log.Printf("Get Package columns: updateID=[%s], products=[%s], classification=[%s], lastUpdated=[%s], version=[%s], size=[%d]",
+		packageInfo.UpdateID, packageInfo.Products, packageInfo.Classification, text(columnLastUpdated), packageInfo.Version, packageInfo.CatalogSize)
+}
+
+// fetchDocument : ページを取得して HTML として解析する
+func (c *HTTPCatalogClient) fetchDocument(ctx context.Context, op string, pageURL string) (*goquery.Document, error) {
+	return c.requestDocument(ctx, op, pageURL, func() (*http.Request, error) {
+		return http.NewRequest("GET", pageURL, nil)
+	})
+}
+
+// postForm : フォームを送信して、結果のページを HTML として解析する
+func (c *HTTPCatalogClient) postForm(ctx context.Context, op string, pageURL string, form url.Values) (*goquery.Document, error) {
+	return c.requestDocument(ctx, op, pageURL, func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", pageURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	})
+}
+
+// requestDocument : リクエストを再試行ポリシーに従って実行し、レスポンスを HTML として解析する
+// 再試行のたびにリクエストを生成し直すため、newRequest を受け取る
+func (c *HTTPCatalogClient) requestDocument(ctx context.Context, op string, pageURL string, newRequest func() (*http.Request, error)) (*goquery.Document, error) {
+	return c.retry().requestDocument(ctx, c.HTTPClient, op, pageURL, newRequest)
+}
+
+// requestDocument : カタログ以外のサイト(サポート技術情報など)からも HTML を取得できるよう、HTTP クライアントを受け取る
+func (policy RetryPolicy) requestDocument(ctx context.Context, client *http.Client, op string, pageURL string, newRequest func() (*http.Request, error)) (*goquery.Document, error) {
+	var doc *goquery.Document
+	err := policy.Do(ctx, op, func(ctx context.Context, _ int) error {
+		req, err := newRequest()
+		if err != nil {
+			return err
+		}
+		return policy.doRequest(ctx, client, op, req, func(resp *http.Response) error {
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return err
+			}
+			doc, err = goquery.NewDocumentFromReader(bytes.NewReader(body))
+			if err != nil {
+				return newParseError(op, pageURL, err)
+			}
+			// リダイレクト後の URL
+			doc.Url = resp.Request.URL
+			return nil
+		})
+	})
+	return doc, err
+}
+
+// downloadInformationRegexp : DownloadDialog のスクリプト中のファイル情報
+// downloadInformation[0].files[1].fileName = 'xxx.msu';
+var downloadInformationRegexp = regexp.MustCompile(`downloadInformation\[0\]\.files\[(\d+)\]\.(\w+) = '([^']*)';`)
+
+// PackageFiles : DownloadDialog から更新プログラムを構成する全てのファイルの情報を取得する
+func (c *HTTPCatalogClient) PackageFiles(ctx context.Context, updateID string) ([]*PackageFile, error) {
+	policy := c.retry()
+	// パッケージ単位の期限
+	ctx, cancel := policy.withPackageTimeout(ctx)
+	defer cancel()
+
+	// Request
+	dialogURL := c.BaseURL + "/DownloadDialog.aspx"
+	data := url.Values{}
+	data.Set("updateIDs", fmt.Sprintf(`[{"size":0,"languages":"","uidInfo":"%s","updateID":"%s"}]`, updateID, updateID))
+
+	//----------------------------------
+	// scraiping for download dialog
+	//----------------------------------
+	var html string
+	err := policy.Do(ctx, "download dialog", func(ctx context.Context, _ int) error {
+		req, err := http.NewRequest(
+			"POST",
+			dialogURL,
+			strings.NewReader(data.Encode()),
+		)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		// Response
+		return policy.doRequest(ctx, c.HTTPClient, "download dialog", req, func(resp *http.Response) error {
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return err
+			}
+			dialogBodyDoc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+			if err != nil {
+				return newParseError("download dialog", dialogURL, err)
+			}
+			html, _ = dialogBodyDoc.Html()
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// ファイルの番号ごとに属性をまとめる
+	indexes := []int{}
+	attrs := map[int]map[string]string{}
+	for _, v := range downloadInformationRegexp.FindAllStringSubmatch(html, -1) {
+		index, _ := strconv.Atoi(v[1])
+		if _, ok := attrs[index]; !ok {
+			indexes = append(indexes, index)
+			attrs[index] = map[string]string{}
+		}
+		attrs[index][v[2]] = v[3]
+	}
+	sort.Ints(indexes)
+
+	files := []*PackageFile{}
+	for _, index := range indexes {
+		m := attrs[index]
+		log.Printf("Get file information: updateID=[%s], index=[%d], m=%s", updateID, index, m)
+		if m["url"] == "" {
+			log.Printf("File has no download link. skip.. : updateID=[%s], index=[%d]", updateID, index)
+			continue
+		}
+		// ファイルサイズの取得(HEAD)
+		size, err := c.fileSize(ctx, m["url"])
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, &PackageFile{
+			DownloadLink: m["url"],
+			Architecture: m["architectures"],
+			FileName:     m["fileName"],
+			Language:     m["longLanguages"],
+			FileSize:     size,
+			Digest:       m["digest"],
+		})
+	}
+	if len(files) == 0 {
+		return nil, newParseError("download dialog", dialogURL, fmt.Errorf("no file found in download dialog: updateID=[%s]", updateID))
+	}
+	return files, nil
+}
+
+// fileSize : HEAD リクエストでファイルサイズを取得する。取得できない場合は -1
+func (c *HTTPCatalogClient) fileSize(ctx context.Context, fileURL string) (int64, error) {
+	policy := c.retry()
+	var size int64
+	err := policy.Do(ctx, "head", func(ctx context.Context, _ int) error {
+		req, err := http.NewRequest("HEAD", fileURL, nil)
+		if err != nil {
+			return err
+		}
+		return policy.doRequest(ctx, c.HTTPClient, "head", req, func(resp *http.Response) error {
+			size = resp.ContentLength
+			return nil
+		})
+	})
+	return size, err
+}
+
+// Download : ファイルの offset バイト目以降のダウンロードを開始する
+func (c *HTTPCatalogClient) Download(ctx context.Context, link string, offset int64) (*http.Response, context.CancelFunc, error) {
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	return c.retry().doStream(ctx, c.HTTPClient, "download", req)
+}
@@ -0,0 +1,255 @@
+package kb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/tsubasaxZZZ/wutools/common/kbtest"
+)
+
+// TestSearch : 検索結果の全てのページ(ポストバック)から更新 ID とタイトルを取得する
+func TestSearch(t *testing.T) {
+	srv, client := newTestCatalog(t)
+
+	result, err := client.Search(context.Background(), "KB4103723")
+	if err != nil {
+		t.Fatalf("Search error = %v", err)
+	}
+	if result.Total != 2 || result.Pages != 2 {
+		t.Errorf("Search = {Total: %d, Pages: %d}, want {Total: 2, Pages: 2}", result.Total, result.Pages)
+	}
+	if got := srv.Requests("/Search.aspx"); got != 2 {
+		t.Errorf("Search.aspx requests = %d, want 2", got)
+	}
+	packages := result.Packages
+	want := []struct{ id, title string }{
+		{"6b4b8a8f-0a5a-4a8b-9a1b-3f1d3c2e4a01", "2018-05 Cumulative Update for Windows Server 2016 for x64-based Systems (KB4103723)"},
+		{"6b4b8a8f-0a5a-4a8b-9a1b-3f1d3c2e4a02", "2018-05 Cumulative Update for Windows 10 Version 1607 for x86-based Systems (KB4103723)"},
+	}
+	if len(packages) != len(want) {
+		t.Fatalf("len(packages) = %d, want %d", len(packages), len(want))
+	}
+	for i, w := range want {
+		if packages[i].UpdateID != w.id || packages[i].Title != w.title {
+			t.Errorf("packages[%d] = {%s, %q}, want {%s, %q}", i, packages[i].UpdateID, packages[i].Title, w.id, w.title)
+		}
+		if len(packages[i].Files) != 0 {
+			t.Errorf("len(packages[%d].Files) = %d, want 0(search result has no file)", i, len(packages[i].Files))
+		}
+	}
+
+	// 検索結果の一覧の列
+	p := packages[0]
+	if p.Products != "Windows Server 2016" || p.Classification != "Security Updates" || p.Version != "n/a" {
+		t.Errorf("Products = %q, Classification = %q, Version = %q", p.Products, p.Classification, p.Version)
+	}
+	if want := time.Date(2018, 5, 8, 0, 0, 0, 0, time.UTC); !p.LastUpdated.Equal(want) {
+		t.Errorf("LastUpdated = %s, want %s", p.LastUpdated, want)
+	}
+	if p.CatalogSize != 65536 {
+		t.Errorf("CatalogSize = %d, want 65536", p.CatalogSize)
+	}
+}
+
+// TestParseResultColumns : 検索結果の行の Products, Classification, Last Updated, Version, Size 列
+func TestParseResultColumns(t *testing.T) {
+	tests := []struct {
+		name  string
+		cells string
+		want  PackageInfo
+	}{
+		{
+			name:  "all columns",
+			cells: `<td></td><td>title</td><td> Windows 10 ,  Windows 10 LTSB </td><td>Security Updates</td><td>5/8/2018</td><td>n/a</td><td><span id="x_size">1.2 GB</span><span id="x_originalSize">1288490188</span></td><td></td>`,
+			want: PackageInfo{
+				Products:       "Windows 10 , Windows 10 LTSB",
+				Classification: "Security Updates",
+				LastUpdated:    time.Date(2018, 5, 8, 0, 0, 0, 0, time.UTC),
+				Version:        "n/a",
+				CatalogSize:    1288490188,
+			},
+		},
+		{
+			name:  "two digit month and day",
+			cells: `<td></td><td>title</td><td>Windows Server 2016</td><td>Updates</td><td>12/31/2019</td><td>1.0</td><td><span id="x_originalSize">1024</span></td><td></td>`,
+			want: PackageInfo{
+				Products:       "Windows Server 2016",
+				Classification: "Updates",
+				LastUpdated:    time.Date(2019, 12, 31, 0, 0, 0, 0, time.UTC),
+				Version:        "1.0",
+				CatalogSize:    1024,
+			},
+		},
+		{
+			name:  "invalid date and size",
+			cells: `<td></td><td>title</td><td>Windows 10</td><td>Drivers</td><td>2018-05-08</td><td></td><td><span id="x_size">64 KB</span></td><td></td>`,
+			want:  PackageInfo{Products: "Windows 10", Classification: "Drivers"},
+		},
+		{
+			name:  "missing columns",
+			cells: `<td></td><td>title</td>`,
+			want:  PackageInfo{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := goquery.NewDocumentFromReader(strings.NewReader("<table><tbody><tr>" + tt.cells + "</tr></tbody></table>"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := PackageInfo{}
+			parseResultColumns(doc.Find("tr").First(), &got)
+			if got.Products != tt.want.Products || got.Classification != tt.want.Classification || !got.LastUpdated.Equal(tt.want.LastUpdated) ||
+				got.Version != tt.want.Version || got.CatalogSize != tt.want.CatalogSize {
+				t.Errorf("parseResultColumns = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSearchNoResult : 該当なしの場合は空の一覧
+func TestSearchNoResult(t *testing.T) {
+	_, client := newTestCatalog(t)
+
+	result, err := client.Search(context.Background(), "nothing here")
+	if err != nil {
+		t.Fatalf("Search error = %v", err)
+	}
+	if len(result.Packages) != 0 || result.Total != 0 {
+		t.Errorf("Search = {Total: %d, Packages: %d}, want none", result.Total, len(result.Packages))
+	}
+}
+
+// TestSearchRetry : サーバエラー(5xx)の場合は再試行する
+func TestSearchRetry(t *testing.T) {
+	srv, client := newTestCatalog(t)
+	srv.FailNext("/Search.aspx", 500, 502)
+
+	result, err := client.Search(context.Background(), "KB4093105")
+	if err != nil {
+		t.Fatalf("Search error = %v", err)
+	}
+	if len(result.Packages) != 1 {
+		t.Errorf("len(Packages) = %d, want 1", len(result.Packages))
+	}
+	if got := srv.Requests("/Search.aspx"); got != 3 {
+		t.Errorf("Search.aspx requests = %d, want 3", got)
+	}
+}
+
+// TestParseSearchDuration : 検索結果の件数表示
+func TestParseSearchDuration(t *testing.T) {
+	tests := []struct {
+		text               string
+		total, page, pages int
+		ok                 bool
+	}{
+		{text: "Updates: 1 - 25 of 436 (page 1 of 18)", total: 436, page: 1, pages: 18, ok: true},
+		{text: " Updates: 26 - 26 of 26 (page 2 of 2) ", total: 26, page: 2, pages: 2, ok: true},
+		{text: "", ok: false},
+		{text: "Updates: 1 - 25", ok: false},
+	}
+	for _, tt := range tests {
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(`<span id="ctl00_catalogBody_searchDuration">` + tt.text + `</span>`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		total, page, pages, ok := parseSearchDuration(doc)
+		if total != tt.total || page != tt.page || pages != tt.pages || ok != tt.ok {
+			t.Errorf("parseSearchDuration(%q) = (%d, %d, %d, %t), want (%d, %d, %d, %t)", tt.text, total, page, pages, ok, tt.total, tt.page, tt.pages, tt.ok)
+		}
+	}
+}
+
+// TestNextPageForm : 次のページのポストバックのフォーム(hidden の値、__EVENTTARGET)と送信先
+func TestNextPageForm(t *testing.T) {
+	const page = `<form name="aspnetForm" method="post" action="./Search.aspx?q=4103723" id="aspnetForm">
+<input type="hidden" name="__VIEWSTATE" value="state" />
+<input type="hidden" name="__EVENTVALIDATION" value="validation" />
+<input type="hidden" name="__EVENTTARGET" value="" />
+%s
+</form>`
+	tests := []struct {
+		name   string
+		link   string
+		ok     bool
+		target string
+	}{
+		{name: "next page", link: `<a id="ctl00_catalogBody_nextPageLinkText" href="javascript:__doPostBack('ctl00$catalogBody$nextPageLinkText','')">Next</a>`, ok: true, target: "ctl00$catalogBody$nextPageLinkText"},
+		{name: "last page", link: ``, ok: false},
+		{name: "not postback", link: `<a id="ctl00_catalogBody_nextPageLinkText" href="#">Next</a>`, ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := goquery.NewDocumentFromReader(strings.NewReader(fmt.Sprintf(page, tt.link)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			form, actionURL, ok := nextPageForm(doc, "https://catalog.example/Search.aspx?q=4103723")
+			if ok != tt.ok {
+				t.Fatalf("nextPageForm ok = %t, want %t", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if actionURL != "https://catalog.example/Search.aspx?q=4103723" {
+				t.Errorf("actionURL = %s", actionURL)
+			}
+			if form.Get("__EVENTTARGET") != tt.target || form.Get("__VIEWSTATE") != "state" || form.Get("__EVENTVALIDATION") != "validation" {
+				t.Errorf("form = %v", form)
+			}
+		})
+	}
+}
+
+// TestPackageFiles : DownloadDialog の複数のファイルを、ファイルの番号順に取得する
+func TestPackageFiles(t *testing.T) {
+	_, client := newTestCatalog(t)
+
+	files, err := client.PackageFiles(context.Background(), "6b4b8a8f-0a5a-4a8b-9a1b-3f1d3c2e4a02")
+	if err != nil {
+		t.Fatalf("PackageFiles error = %v", err)
+	}
+	wantNames := []string{
+		"windows10.0-kb4103723-x86_8b1d0c9e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b2c.msu",
+		"windows10.0-kb4103723-x86_8b1d0c9e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b2c.psf",
+	}
+	if len(files) != len(wantNames) {
+		t.Fatalf("len(files) = %d, want %d", len(files), len(wantNames))
+	}
+	for i, name := range wantNames {
+		f := files[i]
+		if f.FileName != name {
+			t.Errorf("files[%d].FileName = %s, want %s", i, f.FileName, name)
+		}
+		if f.Architecture != "X86" {
+			t.Errorf("files[%d].Architecture = %s, want X86", i, f.Architecture)
+		}
+		// サイズは HEAD で取得する
+		if want := int64(kbtest.Payloads[name]); f.FileSize != want {
+			t.Errorf("files[%d].FileSize = %d, want %d", i, f.FileSize, want)
+		}
+		if f.DownloadLink == "" || f.Digest == "" {
+			t.Errorf("files[%d] DownloadLink = %q, Digest = %q, want both", i, f.DownloadLink, f.Digest)
+		}
+	}
+	// 1つ目は SHA1、2つ目は SHA256 のダイジェスト
+	for i, want := range []string{"SHA1", "SHA256"} {
+		if _, algorithm, _, err := parseDigest(files[i].Digest); err != nil || algorithm != want {
+			t.Errorf("files[%d] digest algorithm = %s(%v), want %s", i, algorithm, err, want)
+		}
+	}
+}
+
+// TestPackageFilesNotFound : DownloadDialog が存在しない更新 ID の場合はエラー
+func TestPackageFilesNotFound(t *testing.T) {
+	_, client := newTestCatalog(t)
+
+	if _, err := client.PackageFiles(context.Background(), "00000000-0000-0000-0000-000000000000"); err == nil {
+		t.Error("PackageFiles error = nil, want error")
+	}
+}
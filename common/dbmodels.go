@@ -5,13 +5,14 @@ import (
 	"crypto/md5"
 	"database/sql"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/Azure/azure-storage-blob-go/2017-07-29/azblob"
@@ -38,8 +39,15 @@ const (
 	StatusError = 0x100
 	// StatusCleanupComplete クリーンアップの完了
 	StatusCleanupComplete = 0x200
+	// StatusFiltered 絞り込み条件で対象外(ダウンロード・アップロードしない)
+	StatusFiltered = 0x400
+	// StatusInterrupted デーモンの停止による中断。中断した段階の状態と組み合わせて格納し、再開時はその段階の続きから処理する
+	StatusInterrupted = 0x800
 )
 
+// ProgressInterval : デーモンがダウンロード・アップロードの進捗を package テーブルに格納する間隔
+var ProgressInterval = 5 * time.Second
+
 type Session struct {
 	ID         sql.NullString
 	Kbno       int
@@ -49,6 +57,14 @@ type Session struct {
 	UpdateDate time.Time
 	Status     int
 	Db         *sql.DB
+	// Filter : パッケージの絞り込み条件(ParseFilter の書式)
+	Filter sql.NullString
+	// Options : KB 情報の取得オプション。Filter はセッションの絞り込み条件で上書きする
+	Options BuildOptions
+	// WorkerID : セッションを取得(Claim)したワーカーの識別子
+	WorkerID string
+	// Attempts : セッションの処理の試行回数(attempt_count)
+	Attempts int
 }
 
 func (session *Session) ChangeStatus(toStatus int) {
@@ -59,7 +75,7 @@ func (session *Session) ChangeStatus(toStatus int) {
 		toStatus, time.Now(), session.ID, session.Kbno,
 	)
 	if err != nil {
-		log.Printf(err.Error())
+		log.Print(err.Error())
 	}
 	session.Status = toStatus
 	log.Printf("Change session status complete: id=[%s], kbno=[%d]",
@@ -67,117 +83,174 @@ func (session *Session) ChangeStatus(toStatus int) {
 
 }
 
-func (packageInfo *PackageInfo) changeStatusPackageInfo(session Session, toStatus int) {
-	log.Printf("Change packageInfo status: id=[%s], kbno=[%d], pkg-name=[%s], from-status=[%d], to-status=[%d]",
-		session.ID.String, session.Kbno, packageInfo.FileName, packageInfo.Status, toStatus)
+// updateArticle : サポート技術情報の KB の記事の情報を session テーブルに格納する
+func (session *Session) updateArticle(article *KBArticle) {
+	_, err := session.Db.Exec(
+		"UPDATE session SET title = ?, release_date = ?, applies_to = ?, update_utc_date=? WHERE id = ? AND kbno = ?",
+		article.Title, nullTime(article.ReleaseDate), strings.Join(article.AppliesTo, "; "), time.Now(), session.ID, session.Kbno,
+	)
+	if err != nil {
+		log.Printf("UPDATE ERROR: id=[%s], kbno=[%d], title=[%s], error=[%v]", session.ID.String, session.Kbno, article.Title, err)
+	}
+}
+
+func (file *PackageFile) changeStatusPackageFile(session Session, packageInfo *PackageInfo, toStatus int) {
+	log.Printf("Change packageFile status: id=[%s], kbno=[%d], pkg-name=[%s], from-status=[%d], to-status=[%d]",
+		session.ID.String, session.Kbno, file.FileName, file.Status, toStatus)
 	_, err := session.Db.Exec(
-		"UPDATE package SET status = ?, update_utc_date=? WHERE session_id = ? AND title = ?",
-		toStatus, time.Now(), session.ID, packageInfo.Title,
+		"UPDATE package SET status = ?, update_utc_date=? WHERE session_id = ? AND kbno = ? AND title = ? AND fileName = ?",
+		toStatus, time.Now(), session.ID, session.Kbno, packageInfo.Title, file.FileName,
 	)
 	if err != nil {
-		log.Printf(err.Error())
+		log.Print(err.Error())
 	}
-	packageInfo.Status = toStatus
-	log.Printf("Change packageInfo status complete: id=[%s], kbno=[%d], pkg-name=[%s]",
-		session.ID.String, session.Kbno, packageInfo.FileName)
+	file.Status = toStatus
+	log.Printf("Change packageFile status complete: id=[%s], kbno=[%d], pkg-name=[%s]",
+		session.ID.String, session.Kbno, file.FileName)
 
 }
 
-func (session Session) ProcessSession() {
+// ProcessSession : セッションの KB のメタデータ取得、ダウンロード、アップロードを行う
+// 失敗したファイルがあった場合は、全てのエラーをまとめて返す
+func (session Session) ProcessSession(ctx context.Context) error {
 
 	// 処理開始
 	log.Printf("Start ProcessSession: id=[%s], kbno=[%d], status=[%d]\n", session.ID.String, session.Kbno, session.Status)
-
-	// ステータスをメタデータ取得中に変更
-	session.ChangeStatus(StatusMetadataInprogress)
-
-	// KB 情報の取得
-	kbinfo := BuildKBInfo(session.Kbno)
-	log.Printf("Complete get KB information: id=[%s], kbinfo=[%+v]", session.ID.String, kbinfo)
-
-	// KB 情報をデータベースに格納
-	log.Printf("INSERT package information: id=[%s], kbno=[%d]", session.ID.String, session.Kbno)
-	for _, p := range kbinfo.PackageInfos {
-		_, err := session.Db.Exec(
-			"INSERT INTO package(session_id, kbno, title, downloadlink, architecture, fileName, language, fileSize, create_utc_date, update_utc_date, status) VALUES(?,?,?,?,?,?,?,?,?,?,?)",
-			session.ID, session.Kbno, p.Title, p.DownloadLink, p.Architecture, p.FileName, p.Language, p.FileSize, time.Now(), time.Now(), StautsMetadataComplete,
-		)
+	// 処理終了
+	defer func() {
+		log.Printf("End ProcessSession: id=[%s], kbno=[%d], status=[%d]\n", session.ID.String, session.Kbno, session.Status)
+	}()
+
+	// 前回の処理が中断された場合は、完了した段階の続きから処理する
+	var kbinfo *KB
+	var err error
+	if session.Status <= StatusMetadataInprogress {
+		kbinfo, err = session.processMetadata(ctx)
 		if err != nil {
-			log.Printf("INSERT ERROR: id=[%s], kbno=[%d]\n", session.ID.String, session.Kbno)
+			return err
+		}
+	} else {
+		// メタデータの取得は完了しているため、格納済みのパッケージの情報から再開する
+		log.Printf("Resume session: id=[%s], kbno=[%d], status=[%d]", session.ID.String, session.Kbno, session.Status)
+		kbinfo, err = session.loadPackages()
+		if err != nil {
+			log.Printf("Load package information error: id=[%s], kbno=[%d], error=[%v]", session.ID.String, session.Kbno, err)
+			session.ChangeStatus(StatusError)
+			return err
 		}
-		p.changeStatusPackageInfo(session, StautsMetadataComplete)
 	}
 
-	// ステータスをメタデータ取得完了に変更
-	session.ChangeStatus(StautsMetadataComplete)
-
 	//----------------------------
 	// SAキーがある場合ダウンロード
 	//----------------------------
 
 	if session.Saname.String == "" || session.Sakey.String == "" {
-		return
+		return nil
+	}
+	// ステータスをダウンロード中に変更(アップロード中に中断した場合は、アップロードしていないファイルが存在するかの確認のみ)
+	if session.Status < StatusDownloadComplete {
+		session.ChangeStatus(StatusDownloadInprogress)
 	}
-	// ステータスをダウンロード中に変更
-	session.ChangeStatus(StatusDownloadInprogress)
+	policy := catalogRetryPolicy()
+	errs := []error{}
 	// ファイルのダウンロード
+	// ディレクトリが存在しない場合はディレクトリを作成
+	if err := os.Mkdir(session.ID.String, 0777); err != nil {
+		log.Printf("Directory is already exists.: id=[%s], kbno=[%d], error=[%s]", session.ID.String, session.Kbno, err.Error())
+	}
+	progress := NewProgress()
 	for _, kbPackageInfo := range kbinfo.PackageInfos {
-		// packageのステータス変更
-		kbPackageInfo.changeStatusPackageInfo(session, StatusDownloadInprogress)
-		// ディレクトリが存在しない場合はディレクトリを作成
-		if err := os.Mkdir(session.ID.String, 0777); err != nil {
-			log.Printf("Directory is already exists.: id=[%s], kbno=[%d], error=[%s]", session.ID.String, session.Kbno, err.Error())
+		for _, file := range kbPackageInfo.Files {
+			progress.Plan(file)
 		}
-
-		filePath := filepath.Join(session.ID.String, kbPackageInfo.FileName)
-
-		err := func() error {
-
-			// ファイルの存在チェック
-			// ファイルが存在する場合は処理をスキップ(1つのKBで、複数OS分のパッケージがリストされている場合、ファイルが同一の場合がある)
-			if _, err := os.Stat(filePath); err == nil {
-				log.Printf("file is exists. skip.. : kb=[%d], fileName=[%s]", session.Kbno, filePath)
-				kbPackageInfo.changeStatusPackageInfo(session, StatusDownloadSkip)
-				return nil
+	}
+	stopProgress := session.reportProgress(progress, "downloaded_bytes", "download")
+	for _, kbPackageInfo := range kbinfo.PackageInfos {
+		for _, file := range kbPackageInfo.Files {
+			filePath := session.filePath(file)
+			// 中断から再開した場合、前回までにダウンロードしたファイルはダウンロードしない
+			if downloadedBefore(file, filePath) {
+				log.Printf("file is already processed. resume.. : kb=[%d], fileName=[%s], status=[%d]", session.Kbno, file.FileName, file.Status)
+				tr := progress.Start(kbPackageInfo, file)
+				tr.Set(file.FileSize)
+				tr.Done()
+				continue
 			}
 
-			log.Printf("start download KB-Pkg : kb=[%d], fileName=[%s], filePath=[%s]", session.Kbno, kbPackageInfo.FileName, filePath)
-			resp, err := http.Get(kbPackageInfo.DownloadLink)
+			// packageのステータス変更
+			previous := file.Status
+			file.changeStatusPackageFile(session, kbPackageInfo, StatusDownloadInprogress)
+			file.startAttempt(session, kbPackageInfo)
+
+			err := func() error {
+				tr := progress.Start(kbPackageInfo, file)
+				defer tr.Done()
+
+				// ファイルの存在チェック
+				// ファイルが存在する場合は処理をスキップ(1つのKBで、複数OS分のパッケージがリストされている場合、ファイルが同一の場合がある)
+				// 再試行・再開したファイルの場合は、前回ダウンロードしたファイルのためアップロードの対象とする
+				if existsVerifiedFile(file, filePath) {
+					tr.Set(file.FileSize)
+					if previous != StautsMetadataComplete {
+						log.Printf("file is already downloaded. : kb=[%d], fileName=[%s], previous-status=[%d]", session.Kbno, filePath, previous)
+						file.changeStatusPackageFile(session, kbPackageInfo, StatusDownloadComplete)
+						return nil
+					}
+					log.Printf("file is exists. skip.. : kb=[%d], fileName=[%s]", session.Kbno, filePath)
+					file.changeStatusPackageFile(session, kbPackageInfo, StatusDownloadSkip)
+					return nil
+				}
+
+				// 再試行可能なエラー(ダイジェスト不一致を含む)の場合はエラーにして再試行
+				ctx, cancel := policy.withPackageTimeout(ctx)
+				defer cancel()
+				return policy.Do(ctx, "download", func(ctx context.Context, attempt int) error {
+					if attempt > 1 {
+						file.changeStatusPackageFile(session, kbPackageInfo, StatusDownloadInprogress)
+					}
+					log.Printf("start download KB-Pkg : kb=[%d], fileName=[%s], filePath=[%s], attempt=[%d]", session.Kbno, file.FileName, filePath, attempt)
+					if err := downloadFile(ctx, file, filePath, tr); err != nil {
+						log.Printf("download error KB-Pkg : kb=[%d], fileName=[%s], attempt=[%d], error=[%v]", session.Kbno, file.FileName, attempt, err)
+						file.changeStatusPackageFile(session, kbPackageInfo, StatusError)
+						return err
+					}
+					log.Printf("end download KB-Pkg : kb=[%d], fileName=[%s]", session.Kbno, file.FileName)
+					// packageのステータス変更
+					file.changeStatusPackageFile(session, kbPackageInfo, StatusDownloadComplete)
+					return nil
+				})
+			}()
 			if err != nil {
-				return err
+				// デーモンの停止による中断の場合は、ダウンロード中のファイルに中断を記録する(次回は一時ファイルの続きからダウンロードする)
+				if ctx.Err() != nil {
+					file.changeStatusPackageFile(session, kbPackageInfo, StatusDownloadInprogress|StatusInterrupted)
+					stopProgress()
+					return session.interrupted(ctx)
+				}
+				file.Status = StatusError
+				log.Print(err)
+				file.recordError(session, kbPackageInfo, err)
+				errs = append(errs, fmt.Errorf("fileName=[%s]: %w", file.FileName, err))
+				continue
 			}
-			defer resp.Body.Close()
-			file, err := os.Create(filePath)
+			// ハッシュの計算
+			hash, err := hashFileMd5(filePath)
 			if err != nil {
-				return err
+				log.Printf("Hash couldn't get : kb=[%d], fileName=[%s]", session.Kbno, file.FileName)
+				file.Status = StatusError
+				file.recordError(session, kbPackageInfo, err)
+				errs = append(errs, fmt.Errorf("fileName=[%s]: %w", file.FileName, err))
+				continue
 			}
-			defer file.Close()
-
-			io.Copy(file, resp.Body)
-			log.Printf("end download KB-Pkg : kb=[%d], fileName=[%s]", session.Kbno, kbPackageInfo.FileName)
-			// packageのステータス変更
-			kbPackageInfo.changeStatusPackageInfo(session, StatusDownloadComplete)
-
-			return nil
-		}()
-		if err != nil {
-			kbPackageInfo.Status = StatusError
-			log.Print(err)
-			continue
-		}
-		// ハッシュの計算
-		hash, err := hashFileMd5(filePath)
-		if err != nil {
-			log.Printf("Hash couldn't get : kb=[%d], fileName=[%s]", session.Kbno, kbPackageInfo.FileName)
-			kbPackageInfo.Status = StatusError
-			continue
+			file.MD5hash = hash
+			log.Printf("Culculated Hash : kb=[%d], fileName=[%s], hash=[%s]", session.Kbno, file.FileName, file.MD5hash)
 		}
-		kbPackageInfo.MD5hash = hash
-		log.Printf("Culculated Hash : kb=[%d], fileName=[%s], hash=[%s]", session.Kbno, kbPackageInfo.FileName, kbPackageInfo.MD5hash)
-
 	}
+	stopProgress()
 	// ステータスをダウンロード完了に変更
-	session.ChangeStatus(StatusDownloadComplete)
+	if session.Status < StatusDownloadComplete {
+		session.ChangeStatus(StatusDownloadComplete)
+	}
 
 	// -----------------------------------
 	// Storage Account へアップロード
@@ -194,34 +267,201 @@ func (session Session) ProcessSession() {
 		fmt.Sprintf("https://%s.blob.core.windows.net/%s", session.Saname.String, containerName))
 	log.Printf("Start create a container: named %s\n", containerName)
 	containerURL := azblob.NewContainerURL(*URL, p)
-	ctx := context.Background() // This example uses a never-expiring context
 
 	if _, err := containerURL.Create(ctx, azblob.Metadata{}, azblob.PublicAccessNone); err != nil {
+		if ctx.Err() != nil {
+			return session.interrupted(ctx)
+		}
 		if err := handleErrors(&session, err); err != nil {
-			goto END
+			return err
 		}
 	}
 
 	log.Printf("Complete create a container : named %s\n", containerName)
 	//test(session.ID.String)
+	progress = NewProgress()
 	for _, kbPackageInfo := range kbinfo.PackageInfos {
-		if kbPackageInfo.Status == StatusDownloadSkip {
-			log.Printf("Skip upload file.: filename=[%s]", kbPackageInfo.FileName)
-			continue
+		for _, file := range kbPackageInfo.Files {
+			if file.Status != StatusDownloadSkip && file.Status != StatusError && file.Status != StatusUploadComplete {
+				progress.Plan(file)
+			}
 		}
-		kbPackageInfo.changeStatusPackageInfo(session, StatusUploadInprogress)
-		uploadToStorageAccount(ctx, &session, kbPackageInfo)
 	}
+	stopProgress = session.reportProgress(progress, "uploaded_bytes", "upload")
+	for _, kbPackageInfo := range kbinfo.PackageInfos {
+		for _, file := range kbPackageInfo.Files {
+			if file.Status == StatusDownloadSkip {
+				log.Printf("Skip upload file.: filename=[%s]", file.FileName)
+				continue
+			}
+			// ダウンロードまたはダイジェストの照合に失敗したファイルはアップロードしない
+			if file.Status == StatusError {
+				log.Printf("Skip upload error file.: filename=[%s]", file.FileName)
+				continue
+			}
+			// 中断から再開した場合、前回までにアップロードしたファイルはアップロードしない
+			if file.Status == StatusUploadComplete {
+				log.Printf("Skip uploaded file.: filename=[%s]", file.FileName)
+				continue
+			}
+			file.changeStatusPackageFile(session, kbPackageInfo, StatusUploadInprogress)
+			tr := progress.Start(kbPackageInfo, file)
+			if err := uploadToStorageAccount(ctx, &session, kbPackageInfo, file, tr); err != nil {
+				if ctx.Err() != nil {
+					file.changeStatusPackageFile(session, kbPackageInfo, StatusUploadInprogress|StatusInterrupted)
+					tr.Done()
+					stopProgress()
+					return session.interrupted(ctx)
+				}
+				file.recordError(session, kbPackageInfo, err)
+				errs = append(errs, fmt.Errorf("fileName=[%s]: %w", file.FileName, err))
+			}
+			tr.Done()
+		}
+	}
+	stopProgress()
 
 	// ディレクトリの削除
 
+	// 失敗したファイルがある場合はエラーにする(ディレクトリを削除せず、再試行でエラーのファイルのみ処理し直す)
+	if len(errs) > 0 {
+		session.ChangeStatus(StatusError)
+		return errors.Join(errs...)
+	}
 	// ステータスをアップロード完了に変更
 	session.ChangeStatus(StatusUploadComplete)
-END:
+	return nil
+}
 
-	// 処理終了
-	log.Printf("End ProcessSession: id=[%s], kbno=[%d], status=[%d]\n", session.ID.String, session.Kbno, session.Status)
+// processMetadata : KB 情報を取得し、パッケージのファイルを package テーブルに格納する
+func (session *Session) processMetadata(ctx context.Context) (*KB, error) {
+	// ステータスをメタデータ取得中に変更
+	session.ChangeStatus(StatusMetadataInprogress)
+
+	// 絞り込み条件の解析
+	opts := session.Options
+	filter, err := ParseFilter(session.Filter.String)
+	if err != nil {
+		log.Printf("Parse filter error: id=[%s], kbno=[%d], filter=[%s], error=[%v]", session.ID.String, session.Kbno, session.Filter.String, err)
+		session.ChangeStatus(StatusError)
+		return nil, err
+	}
+	opts.Filter = filter
+
+	// KB 情報の取得
+	kbinfo, err := BuildKBInfo(ctx, session.Kbno, opts)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, session.interrupted(ctx)
+		}
+		log.Printf("Get KB information error: id=[%s], kbno=[%d], error=[%v]", session.ID.String, session.Kbno, err)
+		session.ChangeStatus(StatusError)
+		return nil, err
+	}
+	log.Printf("Complete get KB information: id=[%s], kbinfo=[%+v]", session.ID.String, kbinfo)
+	if kbinfo.Article != nil {
+		session.updateArticle(kbinfo.Article)
+	}
+
+	// KB 情報をデータベースに格納
+	// 中断したメタデータの取得を再開する場合は、途中まで格納したパッケージを削除してから格納し直す
+	session.deletePackages()
+	log.Printf("INSERT package information: id=[%s], kbno=[%d]", session.ID.String, session.Kbno)
+	// 1ファイル1行で格納
+	for _, p := range kbinfo.PackageInfos {
+		for _, file := range p.Files {
+			session.insertPackageFile(p, file, StautsMetadataComplete, "")
+			file.changeStatusPackageFile(*session, p, StautsMetadataComplete)
+		}
+	}
+	// 絞り込み条件で対象外になったパッケージは理由とともに格納し、ダウンロード・アップロードしない
+	for _, filtered := range kbinfo.Filtered {
+		for _, file := range filtered.Package.Files {
+			session.insertPackageFile(filtered.Package, file, StatusFiltered, filtered.Reason)
+			file.Status = StatusFiltered
+		}
+	}
+
+	// ステータスをメタデータ取得完了に変更
+	session.ChangeStatus(StautsMetadataComplete)
+	return kbinfo, nil
+}
+
+// reportProgress : ProgressInterval ごとに、進捗が変わったファイルの転送済みのバイト数を package テーブルの column に格納し、全体の進捗をログに出力する
+// 返り値の関数で停止する。停止時に最後の進捗を格納する
+func (session Session) reportProgress(progress *Progress, column string, op string) func() {
+	save := func() {
+		for t, n := range progress.Changed() {
+			_, err := session.Db.Exec(
+				fmt.Sprintf("UPDATE package SET %s = ? WHERE session_id = ? AND kbno = ? AND title = ? AND fileName = ?", column),
+				n, session.ID, session.Kbno, t.Package.Title, t.File.FileName,
+			)
+			if err != nil {
+				log.Printf("UPDATE ERROR: id=[%s], kbno=[%d], fileName=[%s], %s=[%d], error=[%v]", session.ID.String, session.Kbno, t.File.FileName, column, n, err)
+			}
+		}
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(ProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				save()
+				log.Printf("%s progress: id=[%s], kbno=[%d], progress=[%s]", op, session.ID.String, session.Kbno, progress.Snapshot())
+			case <-stop:
+				save()
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+		log.Printf("%s result: id=[%s], kbno=[%d], progress=[%s]", op, session.ID.String, session.Kbno, progress.Snapshot())
+	}
+}
+
+// filePath : セッションのディレクトリの下のファイルのパス。カタログのファイル名はサニタイズする
+func (session Session) filePath(file *PackageFile) string {
+	return filepath.Join(session.ID.String, SanitizeFileName(file.FileName))
+}
+
+// insertPackageFile : パッケージのファイルの情報を package テーブルに格納する
+func (session Session) insertPackageFile(p *PackageInfo, file *PackageFile, status int, filterReason string) {
+	args := []interface{}{
+		session.ID, session.Kbno, p.Title, file.DownloadLink, file.Architecture, file.FileName, file.Language, file.FileSize, file.Digest,
+		p.Products, p.Classification, nullTime(p.LastUpdated), p.Version, p.CatalogSize,
+	}
+	args = append(args, detailsValues(p.Details)...)
+	args = append(args, sql.NullString{String: filterReason, Valid: filterReason != ""}, time.Now(), time.Now(), status)
+	_, err := session.Db.Exec(
+		"INSERT INTO package(session_id, kbno, title, downloadlink, architecture, fileName, language, fileSize, digest, products, classification, last_updated, version, catalog_size, "+
+			"msrc_number, msrc_severity, reboot_behavior, requests_user_input, uninstallable, support_url, supersedes, superseded_by, "+
+			"filter_reason, create_utc_date, update_utc_date, status) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
+		args...,
+	)
+	if err != nil {
+		log.Printf("INSERT ERROR: id=[%s], kbno=[%d], fileName=[%s], error=[%v]\n", session.ID.String, session.Kbno, file.FileName, err)
+	}
+}
 
+// nullTime : 未設定の日時を NULL として格納する
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// detailsValues : 詳細ページの情報の package テーブルの列の値。未取得の場合は全て NULL
+func detailsValues(details *UpdateDetails) []interface{} {
+	if details == nil {
+		return make([]interface{}, 8)
+	}
+	return []interface{}{details.MSRCNumber, details.MSRCSeverity, details.RebootBehavior,
+		details.RequestsUserInput, details.Uninstallable, details.SupportURL,
+		joinUpdateTitles(details.Supersedes), joinUpdateTitles(details.SupersededBy)}
 }
 
 func hashFileMd5(filePath string) (string, error) {
@@ -257,33 +497,38 @@ func handleErrors(session *Session, err error) error {
 	return nil
 }
 
-func uploadToStorageAccount(ctx context.Context, session *Session, kbPackageInfo *PackageInfo) error {
-	file, err := os.Open(filepath.Join(session.ID.String, kbPackageInfo.FileName))
+// uploadToStorageAccount : ファイルを Storage Account にアップロードする。アップロードしたバイト数は tr に通知する
+// 中断(ctx の終了)によるエラーの場合は状態を変更しない(呼び出し側で中断を記録する)
+func uploadToStorageAccount(ctx context.Context, session *Session, kbPackageInfo *PackageInfo, file *PackageFile, tr *Transfer) error {
+	f, err := os.Open(session.filePath(file))
 	if err != nil {
 		handleErrors(session, err)
-		kbPackageInfo.changeStatusPackageInfo(*session, StatusError)
+		file.changeStatusPackageFile(*session, kbPackageInfo, StatusError)
 		return err
 	}
-	defer file.Close()
-	u, _ := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net/kbdownloader/%s", session.Saname.String, fmt.Sprintf("%s/%s", session.ID.String, kbPackageInfo.FileName)))
+	defer f.Close()
+	u, _ := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net/kbdownloader/%s", session.Saname.String, fmt.Sprintf("%s/%s", session.ID.String, SanitizeFileName(file.FileName))))
 	blockBlobURL := azblob.NewBlockBlobURL(*u, azblob.NewPipeline(azblob.NewSharedKeyCredential(session.Saname.String, session.Sakey.String), azblob.PipelineOptions{}))
-	log.Printf("Uploading the file with blob name: %s\n", kbPackageInfo.FileName)
-	_, berr := azblob.UploadFileToBlockBlob(ctx, file, blockBlobURL, azblob.UploadToBlockBlobOptions{
+	log.Printf("Uploading the file with blob name: %s\n", file.FileName)
+	_, berr := azblob.UploadFileToBlockBlob(ctx, f, blockBlobURL, azblob.UploadToBlockBlobOptions{
 		BlockSize: 4 * 1024 * 1024,
-
-		/*Progress: func(bytesTransferred int64) {
-			fmt.Printf("Uploaded %d of %d bytes.\n", bytesTransferred, kbPackageInfo.FileSize)
-		},*/
+		// bytesTransferred はファイル全体のアップロード済みのバイト数
+		Progress: func(bytesTransferred int64) {
+			tr.Add(bytesTransferred - tr.Transferred())
+		},
 		Parallelism: 1,
 	})
 	if berr != nil {
-		handleErrors(session, err)
-		kbPackageInfo.changeStatusPackageInfo(*session, StatusError)
+		if ctx.Err() != nil {
+			return berr
+		}
+		handleErrors(session, berr)
+		file.changeStatusPackageFile(*session, kbPackageInfo, StatusError)
 		return berr
 	}
 	// ハッシュの取得と比較
 
-	kbPackageInfo.changeStatusPackageInfo(*session, StatusUploadComplete)
+	file.changeStatusPackageFile(*session, kbPackageInfo, StatusUploadComplete)
 
 	return nil
 }
@@ -0,0 +1,147 @@
+package kb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// UpdateDetails : 更新プログラムの詳細ページ(ScopedViewInline)の情報
+type UpdateDetails struct {
+	// Architecture : アーキテクチャ(AMD64 など)
+	Architecture string `json:"architecture,omitempty"`
+	// Classification : 分類(Security Updates など)
+	Classification string `json:"classification,omitempty"`
+	// Products : 対象の製品(Windows 10 など)。複数の場合は "," 区切り
+	Products string `json:"products,omitempty"`
+	// MSRCNumber : セキュリティ情報の番号(MS18-xxx など)。ない場合は空
+	MSRCNumber string `json:"msrcNumber,omitempty"`
+	// MSRCSeverity : 深刻度(Critical など)。ない場合は空
+	MSRCSeverity string `json:"msrcSeverity,omitempty"`
+	// RebootBehavior : 再起動の要否(Can request restart など)
+	RebootBehavior string `json:"rebootBehavior,omitempty"`
+	// RequestsUserInput : ユーザーの入力を求める場合がある
+	RequestsUserInput bool `json:"requestsUserInput"`
+	// Uninstallable : アンインストール可能
+	Uninstallable bool `json:"uninstallable"`
+	// SupportURL : サポート情報の URL
+	SupportURL string `json:"supportUrl,omitempty"`
+	// Supersedes : この更新プログラムが置き換える更新プログラム
+	Supersedes []UpdateRef `json:"supersedes,omitempty"`
+	// SupersededBy : この更新プログラムを置き換える更新プログラム
+	SupersededBy []UpdateRef `json:"supersededBy,omitempty"`
+}
+
+// UpdateRef : 置き換え関係にある更新プログラム
+// 詳細ページの Supersedes にはリンクがないため、UpdateID は SupersededBy の場合のみ設定される
+type UpdateRef struct {
+	UpdateID string `json:"updateId,omitempty"`
+	Title    string `json:"title"`
+	// KBNo : タイトルの KBxxxxxxx から取得した KB 番号。ない場合は 0
+	KBNo int `json:"kb,omitempty"`
+}
+
+// kbInTitleRegexp : タイトル中の KB 番号
+// (KB4103723) のほか、定義ファイルなどの - KB2267602 (Version ...) の形式がある
+var kbInTitleRegexp = regexp.MustCompile(`\bKB(\d+)\b`)
+
+// KBNoFromTitle : タイトル中の KB 番号。ない場合は 0
+func KBNoFromTitle(title string) int {
+	m := kbInTitleRegexp.FindStringSubmatch(title)
+	if m == nil {
+		return 0
+	}
+	no, _ := strconv.Atoi(m[1])
+	return no
+}
+
+// newUpdateRef : タイトルと UpdateID から UpdateRef を生成する
+func newUpdateRef(updateID string, title string) UpdateRef {
+	return UpdateRef{UpdateID: updateID, Title: title, KBNo: KBNoFromTitle(title)}
+}
+
+// Details : 詳細ページ(ScopedViewInline)から置き換え関係、MSRC の深刻度、再起動の要否などを取得する
+func (c *HTTPCatalogClient) Details(ctx context.Context, updateID string) (*UpdateDetails, error) {
+	detailsURL := fmt.Sprintf("%s/ScopedViewInline.aspx?updateid=%s", c.BaseURL, url.QueryEscape(updateID))
+	doc, err := c.fetchDocument(ctx, "details", detailsURL)
+	if err != nil {
+		return nil, err
+	}
+	// 存在しない updateid の場合もエラーページが 200 で返ってくる
+	if doc.Find("#updateDetails").Length() == 0 {
+		return nil, newParseError("details", detailsURL, fmt.Errorf("no update details found: updateID=[%s]", updateID))
+	}
+	details := parseDetails(doc)
+	log.Printf("Get update details: updateID=[%s], architecture=[%s], products=[%s], msrcNumber=[%s], msrcSeverity=[%s], rebootBehavior=[%s], supersedes=[%d], supersededBy=[%d]",
+		updateID, details.Architecture, details.Products, details.MSRCNumber, details.MSRCSeverity, details.RebootBehavior, len(details.Supersedes), len(details.SupersededBy))
+	return details, nil
+}
+
+// parseDetails : 詳細ページを解析する
+func parseDetails(doc *goquery.Document) *UpdateDetails {
+	details := &UpdateDetails{
+		Architecture:   detailsValue(doc.Find("#archDiv")),
+		Classification: detailsValue(doc.Find("#classificationDiv")),
+		Products:       detailsValue(doc.Find("#productsDiv")),
+		MSRCNumber:     detailsValue(doc.Find("#securityBullitenDiv")),
+		MSRCSeverity:   detailsValue(doc.Find("#msrcSeverityDiv")),
+		RebootBehavior: detailsValue(doc.Find("#rebootBehaviorDiv")),
+	}
+	// May request user input: Yes / No
+	details.RequestsUserInput = strings.EqualFold(detailsValue(doc.Find("#userInputDiv")), "Yes")
+	// Uninstall Notes: "This software update can be removed ..." / "This software update can not be removed."
+	notes := strings.ToLower(detailsValue(doc.Find("#uninstallNotesDiv")))
+	details.Uninstallable = strings.Contains(notes, "can be removed")
+	details.SupportURL = strings.TrimSpace(doc.Find("#suportUrlDiv a").First().AttrOr("href", ""))
+	if details.SupportURL == "" {
+		details.SupportURL = strings.TrimSpace(doc.Find("#moreInfoDiv a").First().AttrOr("href", ""))
+	}
+
+	// Supersedes はタイトルのみ
+	doc.Find("#supersedesInfo > div").Each(func(_ int, s *goquery.Selection) {
+		if title := normalizeText(s.Text()); title != "" && !isNotApplicable(title) {
+			details.Supersedes = append(details.Supersedes, newUpdateRef("", title))
+		}
+	})
+	// Superseded by は詳細ページへのリンク
+	doc.Find("#supersededbyInfo > div").Each(func(_ int, s *goquery.Selection) {
+		title := normalizeText(s.Text())
+		if title == "" || isNotApplicable(title) {
+			return
+		}
+		updateID := ""
+		if href, ok := s.Find("a").Attr("href"); ok {
+			if u, err := url.Parse(href); err == nil {
+				updateID = u.Query().Get("updateid")
+			}
+		}
+		details.SupersededBy = append(details.SupersededBy, newUpdateRef(updateID, title))
+	})
+	return details
+}
+
+// detailsValue : 詳細ページの項目の値。ラベル(.labelTitle)を除いたテキスト。n/a の場合は空
+func detailsValue(s *goquery.Selection) string {
+	s = s.Clone()
+	s.Find(".labelTitle").Remove()
+	v := normalizeText(s.Text())
+	if isNotApplicable(v) {
+		return ""
+	}
+	return v
+}
+
+// normalizeText : 連続する空白・改行を1つの空白にまとめる
+func normalizeText(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func isNotApplicable(s string) bool {
+	return strings.EqualFold(s, "n/a")
+}
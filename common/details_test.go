@@ -0,0 +1,143 @@
+package kb
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// TestDetails : 詳細ページからアーキテクチャ、製品、MSRC の深刻度、再起動の要否、置き換え関係などを取得する
+func TestDetails(t *testing.T) {
+	_, client := newTestCatalog(t)
+
+	tests := []struct {
+		updateID string
+		want     UpdateDetails
+	}{
+		{
+			updateID: "6b4b8a8f-0a5a-4a8b-9a1b-3f1d3c2e4a01",
+			want: UpdateDetails{
+				Architecture:   "AMD64",
+				Classification: "Security Updates",
+				Products:       "Windows Server 2016",
+				MSRCSeverity:   "Critical",
+				RebootBehavior: "Can request restart",
+				Uninstallable:  true,
+				SupportURL:     "https://support.microsoft.com/help/4103723",
+				Supersedes: []UpdateRef{
+					{Title: "2018-04 Cumulative Update for Windows Server 2016 for x64-based Systems (KB4093119)", KBNo: 4093119},
+					{Title: "2018-04 Cumulative Update for Windows Server 2016 for x64-based Systems (KB4093120)", KBNo: 4093120},
+				},
+			},
+		},
+		{
+			updateID: "9c2f1e7d-5b3a-4c6e-8d7f-1a2b3c4d5e03",
+			want: UpdateDetails{
+				Architecture:   "AMD64",
+				Classification: "Updates",
+				Products:       "Windows 10",
+				RebootBehavior: "Can request restart",
+				SupportURL:     "https://support.microsoft.com/help/4093105",
+				Supersedes: []UpdateRef{
+					{Title: "2018-04 Cumulative Update for Windows 10 Version 1709 for x64-based Systems (KB4093112)", KBNo: 4093112},
+				},
+				SupersededBy: []UpdateRef{
+					{UpdateID: "9c2f1e7d-5b3a-4c6e-8d7f-1a2b3c4d5e04", Title: "2018-05 Cumulative Update for Windows 10 Version 1709 for x64-based Systems (KB4103727)", KBNo: 4103727},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.updateID, func(t *testing.T) {
+			got, err := client.Details(context.Background(), tt.updateID)
+			if err != nil {
+				t.Fatalf("Details error = %v", err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("Details = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+// TestDetailsNotFound : 存在しない更新 ID の場合はエラーページ(200)が返るため、解析エラーとする
+func TestDetailsNotFound(t *testing.T) {
+	_, client := newTestCatalog(t)
+
+	if _, err := client.Details(context.Background(), "00000000-0000-0000-0000-000000000000"); err == nil {
+		t.Error("Details error = nil, want error")
+	}
+}
+
+// TestParseDetails : 項目のラベルの除去、n/a、MSRC の番号、ユーザー入力、サポート URL の代替
+func TestParseDetails(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want UpdateDetails
+	}{
+		{
+			name: "msrc number and user input",
+			html: `<div id="securityBullitenDiv"><span class="labelTitle">MSRC Number:</span><br /> MS18-001 </div>
+<div id="msrcSeverityDiv"><span class="labelTitle">MSRC severity:</span><br /><span>Important</span></div>
+<div id="userInputDiv"><span class="labelTitle">May request user input:</span><br /><span>yes</span></div>
+<div id="rebootBehaviorDiv"><span class="labelTitle">Restart behavior:</span><br /><span>Required</span></div>`,
+			want: UpdateDetails{MSRCNumber: "MS18-001", MSRCSeverity: "Important", RequestsUserInput: true, RebootBehavior: "Required"},
+		},
+		{
+			name: "not applicable values",
+			html: `<div id="securityBullitenDiv"><span class="labelTitle">MSRC Number:</span><br /> N/A</div>
+<div id="msrcSeverityDiv"><span class="labelTitle">MSRC severity:</span><br /><span>n/a</span></div>
+<div id="uninstallNotesDiv"><span class="labelTitle">Uninstall Notes:</span><br /> This software update can not be removed.</div>
+<div id="supersedesInfo"><div> n/a </div></div>
+<div id="supersededbyInfo"><div>n/a</div></div>`,
+			want: UpdateDetails{},
+		},
+		{
+			name: "more information as support url",
+			html: `<div id="moreInfoDiv"><span class="labelTitle">More information:</span><br /><a href=" https://support.microsoft.com/help/4093105 ">link</a></div>`,
+			want: UpdateDetails{SupportURL: "https://support.microsoft.com/help/4093105"},
+		},
+		{
+			name: "superseded by without link or kb",
+			html: `<div id="supersededbyInfo"><div>
+    Windows Malicious Software Removal Tool
+</div></div>`,
+			want: UpdateDetails{SupersededBy: []UpdateRef{{Title: "Windows Malicious Software Removal Tool"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := goquery.NewDocumentFromReader(strings.NewReader(`<div id="updateDetails">` + tt.html + `</div>`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := parseDetails(doc); !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("parseDetails = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+// TestNewKBListDetails : BuildOptions.Details を指定した場合のみ、パッケージごとに詳細ページを取得する
+func TestNewKBListDetails(t *testing.T) {
+	srv, _ := newTestCatalog(t)
+
+	for _, opts := range []BuildOptions{{}, {Details: true}} {
+		list, err := NewKBList(context.Background(), []KBSpec{{No: 4103723}}, 2, opts)
+		if err != nil {
+			t.Fatalf("NewKBList(%+v) error = %v", opts, err)
+		}
+		for _, p := range list.KBs()[0].PackageInfos {
+			if (p.Details != nil) != opts.Details {
+				t.Errorf("NewKBList(%+v) %s Details = %+v", opts, p.UpdateID, p.Details)
+			}
+		}
+	}
+	if got := srv.Requests("/ScopedViewInline.aspx"); got != 2 {
+		t.Errorf("ScopedViewInline.aspx requests = %d, want 2", got)
+	}
+}
@@ -0,0 +1,219 @@
+package kb
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// partialSuffix : ダウンロード中の一時ファイルの拡張子
+const partialSuffix = ".partial"
+
+var (
+	// ErrDigestMismatch : ダウンロードしたファイルのハッシュがカタログの公開値と一致しない
+	ErrDigestMismatch = errors.New("digest mismatch")
+	// ErrSizeMismatch : ダウンロードしたファイルのサイズがカタログの値と一致しない
+	ErrSizeMismatch = errors.New("size mismatch")
+)
+
+// DigestMismatchError : ダイジェスト不一致の詳細
+type DigestMismatchError struct {
+	FilePath  string
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("%s %s: file=[%s], expected=[%s], actual=[%s]", e.Algorithm, ErrDigestMismatch, e.FilePath, e.Expected, e.Actual)
+}
+
+func (e *DigestMismatchError) Is(target error) bool {
+	return target == ErrDigestMismatch
+}
+
+// parseDigest : カタログのダイジェスト(Base64 または 16進数)をバイト列に変換し、アルゴリズムを判定する
+func parseDigest(digest string) ([]byte, string, func() hash.Hash, error) {
+	digest = strings.TrimSpace(digest)
+	sum, err := base64.StdEncoding.DecodeString(digest)
+	if err != nil || (len(sum) != sha1.Size && len(sum) != sha256.Size) {
+		if sum, err = hex.DecodeString(digest); err != nil {
+			return nil, "", nil, fmt.Errorf("invalid digest format: digest=[%s]", digest)
+		}
+	}
+	switch len(sum) {
+	case sha1.Size:
+		return sum, "SHA1", sha1.New, nil
+	case sha256.Size:
+		return sum, "SHA256", sha256.New, nil
+	}
+	return nil, "", nil, fmt.Errorf("unknown digest length: digest=[%s]", digest)
+}
+
+// VerifyDigest : ファイルのハッシュをカタログが公開しているダイジェスト(SHA1 / SHA256)と比較する
+// ダイジェストが公開されていない場合は検証できないため nil を返す
+func VerifyDigest(filePath string, digest string) error {
+	if digest == "" {
+		log.Printf("Digest is not published. skip verify.. : filePath=[%s]", filePath)
+		return nil
+	}
+	expected, algorithm, newHash, err := parseDigest(digest)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	h := newHash()
+	if _, err := io.Copy(h, file); err != nil {
+		return err
+	}
+	actual := h.Sum(nil)
+	if !bytes.Equal(actual, expected) {
+		return &DigestMismatchError{
+			FilePath:  filePath,
+			Algorithm: algorithm,
+			Expected:  base64.StdEncoding.EncodeToString(expected),
+			Actual:    base64.StdEncoding.EncodeToString(actual),
+		}
+	}
+	log.Printf("Digest verified : filePath=[%s], algorithm=[%s]", filePath, algorithm)
+	return nil
+}
+
+// VerifyFile : ダウンロード済みのファイルのサイズとダイジェストを検証する
+func VerifyFile(file *PackageFile, filePath string) error {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	// HEAD でサイズが取得できなかった場合(-1)はサイズの検証を行わない
+	if file.FileSize > 0 && info.Size() != file.FileSize {
+		return fmt.Errorf("%w: file=[%s], expected=[%d], actual=[%d]", ErrSizeMismatch, filePath, file.FileSize, info.Size())
+	}
+	return VerifyDigest(filePath, file.Digest)
+}
+
+// existsVerifiedFile : ファイルが存在し、検証にも成功するかどうか
+// 検証に失敗したファイルは削除する
+func existsVerifiedFile(file *PackageFile, filePath string) bool {
+	if _, err := os.Stat(filePath); err != nil {
+		return false
+	}
+	if err := VerifyFile(file, filePath); err != nil {
+		log.Printf("file is exists, but invalid. re-download.. : filePath=[%s], error=[%v]", filePath, err)
+		if rerr := os.Remove(filePath); rerr != nil {
+			log.Printf("Remove file error: filePath=[%s], error=[%v]", filePath, rerr)
+		}
+		return false
+	}
+	return true
+}
+
+// downloadFile : ファイルを一時ファイル(.partial)にダウンロードし、検証に成功した場合のみ本来のファイル名に変更する
+// 一時ファイルが残っている場合は Range リクエストで続きからダウンロードする
+// 検証に失敗した場合は一時ファイルを削除する。転送したバイト数は tr に通知する(nil の場合は通知しない)
+func downloadFile(ctx context.Context, file *PackageFile, filePath string, tr *Transfer) error {
+	partialPath := filePath + partialSuffix
+
+	var offset int64
+	if info, err := os.Stat(partialPath); err == nil {
+		offset = info.Size()
+	}
+	if err := fetchToPartial(ctx, file, partialPath, offset, tr); err != nil {
+		return err
+	}
+
+	if err := VerifyFile(file, partialPath); err != nil {
+		if rerr := os.Remove(partialPath); rerr != nil {
+			log.Printf("Remove file error: filePath=[%s], error=[%v]", partialPath, rerr)
+		}
+		return err
+	}
+	return os.Rename(partialPath, filePath)
+}
+
+// fetchToPartial : 一時ファイルの offset バイト目以降をダウンロードする
+// サーバが Range に対応していない場合は先頭からダウンロードし直す
+func fetchToPartial(ctx context.Context, file *PackageFile, partialPath string, offset int64, tr *Transfer) error {
+	// 既にサイズ分ダウンロード済み
+	if offset > 0 && file.FileSize > 0 && offset >= file.FileSize {
+		tr.Set(offset)
+		return nil
+	}
+
+	resp, cancel, err := DefaultCatalog.Download(ctx, file.DownloadLink, offset)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	flag := os.O_CREATE | os.O_WRONLY
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0 && contentRangeStart(resp) == offset:
+		log.Printf("resume download : filePath=[%s], offset=[%d]", partialPath, offset)
+		flag |= os.O_APPEND
+		tr.Set(offset)
+	case resp.StatusCode == http.StatusOK || (resp.StatusCode == http.StatusPartialContent && contentRangeStart(resp) == 0):
+		if offset > 0 {
+			log.Printf("server does not support range request. restart download : filePath=[%s]", partialPath)
+		}
+		flag |= os.O_TRUNC
+		tr.Set(0)
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		// 要求と異なる位置からの応答は続きとして書き込めないため、一時ファイルを破棄して先頭からダウンロードし直す
+		log.Printf("content range does not match offset. restart download : filePath=[%s], offset=[%d], contentRange=[%s]",
+			partialPath, offset, resp.Header.Get("Content-Range"))
+		cancel()
+		if err := os.Truncate(partialPath, 0); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return fetchToPartial(ctx, file, partialPath, 0, tr)
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// 一時ファイルが既に完全な場合。検証で判断する
+		tr.Set(offset)
+		return nil
+	default:
+		if err := checkResponse("download", resp); err != nil {
+			return err
+		}
+		return &RequestError{Kind: ErrUnexpectedStatus, Op: "download", URL: file.DownloadLink, StatusCode: resp.StatusCode}
+	}
+
+	f, err := os.OpenFile(partialPath, flag, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, NewProgressReader(resp.Body, tr.Add))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	// 途中で切断された場合は一時ファイルを残し、次回続きからダウンロードする
+	if err != nil {
+		return newTransportError("download", file.DownloadLink, err)
+	}
+	return nil
+}
+
+// contentRangeStart : Content-Range ヘッダ(bytes 100-199/200)の開始位置
+func contentRangeStart(resp *http.Response) int64 {
+	var start, end, total int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total); err != nil {
+		return -1
+	}
+	return start
+}
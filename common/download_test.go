@@ -0,0 +1,260 @@
+package kb
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/tsubasaxZZZ/wutools/common/kbtest"
+)
+
+const (
+	testPsfName = "windows10.0-kb4103723-x86_8b1d0c9e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b2c.psf"
+	testPsfPath = "/d/msdownload/update/software/secu/2018/05/" + testPsfName
+	testMsuName = "windows10.0-kb4103723-x64_2adf2780c6f8c1ebb9f8b2e0c0e1a5f0e2b3a4c5.msu"
+)
+
+// rangeRecorder : ファイルのダウンロード(GET)のリクエストの Range ヘッダをファイル名ごとに記録する
+type rangeRecorder struct {
+	mu     sync.Mutex
+	ranges map[string][]string
+}
+
+func (r *rangeRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == "GET" {
+		r.mu.Lock()
+		r.ranges[path.Base(req.URL.Path)] = append(r.ranges[path.Base(req.URL.Path)], req.Header.Get("Range"))
+		r.mu.Unlock()
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// newTestKBList : 偽サーバから KB4103723(2つの更新プログラム、3つのファイル)を取得する
+// ダウンロード先(DownloadOptions.OutDir)はテスト用の一時ディレクトリ
+func newTestKBList(t *testing.T) (*kbtest.CatalogServer, *KBList, string) {
+	t.Helper()
+	srv, _ := newTestCatalog(t)
+	list, err := NewKBList(context.Background(), []KBSpec{{No: 4103723}}, 2, BuildOptions{})
+	if err != nil {
+		t.Fatalf("NewKBList error = %v", err)
+	}
+	return srv, list, t.TempDir()
+}
+
+// testFile : KB の一覧からファイル名のファイルを探す
+func testFile(t *testing.T, list *KBList, name string) *PackageFile {
+	t.Helper()
+	for _, kb := range list.KBs() {
+		for _, p := range kb.PackageInfos {
+			for _, f := range p.Files {
+				if f.FileName == name {
+					return f
+				}
+			}
+		}
+	}
+	t.Fatalf("file not found: %s", name)
+	return nil
+}
+
+// assertDownloaded : ファイルがダウンロード済み(内容が偽サーバのファイルと一致し、一時ファイルがない)
+func assertDownloaded(t *testing.T, path string, name string) {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read downloaded file: %v", err)
+	}
+	if !bytes.Equal(b, kbtest.Payload(name)) {
+		t.Errorf("content of %s does not match payload", name)
+	}
+	if _, err := os.Stat(path + partialSuffix); !os.IsNotExist(err) {
+		t.Errorf("partial file remains: %s", path+partialSuffix)
+	}
+}
+
+// TestDownloadAllKB : 全てのファイルをダウンロードし、サーバエラー(5xx)の場合は再試行する
+// 2回目はダウンロード済みのファイルを検証してスキップする
+func TestDownloadAllKB(t *testing.T) {
+	srv, list, dir := newTestKBList(t)
+	srv.FailNext(testPsfPath, 500)
+	// ファイルサイズの取得(HEAD)のリクエストは除く
+	before := srv.Requests(testPsfPath)
+
+	if err := list.DownloadAllKB(context.Background(), 2, DownloadOptions{OutDir: dir}); err != nil {
+		t.Fatalf("DownloadAllKB error = %v", err)
+	}
+	files := 0
+	for _, kb := range list.KBs() {
+		for _, p := range kb.PackageInfos {
+			for _, f := range p.Files {
+				files++
+				if f.Status != StatusDownloadComplete {
+					t.Errorf("%s Status = %d, want %d", f.FileName, f.Status, StatusDownloadComplete)
+				}
+				assertDownloaded(t, filepath.Join(dir, f.FileName), f.FileName)
+			}
+		}
+	}
+	if files != 3 {
+		t.Errorf("files = %d, want 3", files)
+	}
+	if got := srv.Requests(testPsfPath) - before; got != 2 {
+		t.Errorf("%s requests = %d, want 2(retry after 500)", testPsfName, got)
+	}
+
+	if err := list.DownloadAllKB(context.Background(), 2, DownloadOptions{OutDir: dir}); err != nil {
+		t.Fatalf("DownloadAllKB(second) error = %v", err)
+	}
+	if f := testFile(t, list, testPsfName); f.Status != StatusDownloadSkip {
+		t.Errorf("second download Status = %d, want %d", f.Status, StatusDownloadSkip)
+	}
+	if got := srv.Requests(testPsfPath) - before; got != 2 {
+		t.Errorf("%s requests = %d, want 2(skip verified file)", testPsfName, got)
+	}
+}
+
+// TestDownloadAllKBCatalogRetry : ダウンロードの再試行には使用しているカタログのクライアントの再試行ポリシーを使う
+func TestDownloadAllKBCatalogRetry(t *testing.T) {
+	srv, list, dir := newTestKBList(t)
+	DefaultCatalog.(*HTTPCatalogClient).Retry = RetryPolicy{MaxAttempts: 1}
+	srv.FailNext(testPsfPath, 500)
+	before := srv.Requests(testPsfPath)
+
+	if err := list.DownloadAllKB(context.Background(), 2, DownloadOptions{OutDir: dir}); !errors.Is(err, ErrServer) {
+		t.Fatalf("DownloadAllKB error = %v, want %v", err, ErrServer)
+	}
+	if got := srv.Requests(testPsfPath) - before; got != 1 {
+		t.Errorf("%s requests = %d, want 1(no retry)", testPsfName, got)
+	}
+	assertDownloaded(t, filepath.Join(dir, testMsuName), testMsuName)
+}
+
+// TestDownloadAllKBDigestMismatch : ダイジェストが一致しないファイルは保存せず、一時ファイルも削除する
+func TestDownloadAllKBDigestMismatch(t *testing.T) {
+	_, list, dir := newTestKBList(t)
+	f := testFile(t, list, testMsuName)
+	sum := sha1.Sum([]byte("tampered"))
+	f.Digest = base64.StdEncoding.EncodeToString(sum[:])
+
+	err := list.DownloadAllKB(context.Background(), 2, DownloadOptions{OutDir: dir})
+	if !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("DownloadAllKB error = %v, want %v", err, ErrDigestMismatch)
+	}
+	if f.Status != StatusError {
+		t.Errorf("Status = %d, want %d", f.Status, StatusError)
+	}
+	path := filepath.Join(dir, testMsuName)
+	for _, p := range []string{path, path + partialSuffix} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("file remains after digest mismatch: %s", p)
+		}
+	}
+	// 他のファイルはダウンロードできている
+	assertDownloaded(t, filepath.Join(dir, testPsfName), testPsfName)
+}
+
+// TestDownloadAllKBResume : 一時ファイル(.partial)が残っている場合は続きから(Range リクエストで)ダウンロードする
+func TestDownloadAllKBResume(t *testing.T) {
+	srv, list, dir := newTestKBList(t)
+	recorder := &rangeRecorder{ranges: map[string][]string{}}
+	DefaultCatalog = NewCatalogClient(srv.URL, &http.Client{Transport: recorder})
+
+	payload := kbtest.Payload(testMsuName)
+	offset := len(payload) / 3
+	path := filepath.Join(dir, testMsuName)
+	if err := os.WriteFile(path+partialSuffix, payload[:offset], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := list.DownloadAllKB(context.Background(), 2, DownloadOptions{OutDir: dir}); err != nil {
+		t.Fatalf("DownloadAllKB error = %v", err)
+	}
+	assertDownloaded(t, path, testMsuName)
+
+	want := fmt.Sprintf("bytes=%d-", offset)
+	if got := recorder.ranges[testMsuName]; len(got) != 1 || got[0] != want {
+		t.Errorf("Range of %s = %q, want [%q]", testMsuName, got, want)
+	}
+	// 一時ファイルのないファイルは先頭からダウンロードする
+	if got := recorder.ranges[testPsfName]; len(got) != 1 || got[0] != "" {
+		t.Errorf("Range of %s = %q, want no Range", testPsfName, got)
+	}
+}
+
+// rangeShifter : ファイルのダウンロードの Range リクエストの開始位置を start に変え、要求と異なる位置からの部分的な応答(206)を返させる
+type rangeShifter struct {
+	start    int64
+	recorder *rangeRecorder
+}
+
+func (s *rangeShifter) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Range") != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", s.start))
+	}
+	return s.recorder.RoundTrip(req)
+}
+
+// TestDownloadAllKBResumeRangeMismatch : 206 の Content-Range の開始位置が一時ファイルのサイズと異なる場合は、
+// 一時ファイルを破棄して先頭から書き込む(開始位置が 0 でない場合は先頭からダウンロードし直す)
+func TestDownloadAllKBResumeRangeMismatch(t *testing.T) {
+	tests := []struct {
+		start int64
+		want  []string
+	}{
+		{start: 0, want: []string{"bytes=0-"}},
+		{start: 100, want: []string{"bytes=100-", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.start), func(t *testing.T) {
+			srv, list, dir := newTestKBList(t)
+			recorder := &rangeRecorder{ranges: map[string][]string{}}
+			DefaultCatalog = NewCatalogClient(srv.URL, &http.Client{Transport: &rangeShifter{start: tt.start, recorder: recorder}})
+
+			payload := kbtest.Payload(testMsuName)
+			path := filepath.Join(dir, testMsuName)
+			if err := os.WriteFile(path+partialSuffix, payload[:len(payload)/3], 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := list.DownloadAllKB(context.Background(), 2, DownloadOptions{OutDir: dir}); err != nil {
+				t.Fatalf("DownloadAllKB error = %v", err)
+			}
+			assertDownloaded(t, path, testMsuName)
+			if got := recorder.ranges[testMsuName]; fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("Range of %s = %q, want %q", testMsuName, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestDownloadAllKBLayout : 配置のテンプレートに従って出力先ディレクトリの下に保存する
+func TestDownloadAllKBLayout(t *testing.T) {
+	_, list, dir := newTestKBList(t)
+	layout, err := ParseLayout("{kb}/{arch}/{filename}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outDir := filepath.Join(dir, "out")
+
+	if err := list.DownloadAllKB(context.Background(), 2, DownloadOptions{OutDir: outDir, Layout: layout}); err != nil {
+		t.Fatalf("DownloadAllKB error = %v", err)
+	}
+	for _, name := range []string{testMsuName, testPsfName} {
+		f := testFile(t, list, name)
+		want := filepath.Join(outDir, "4103723", f.Architecture, name)
+		if f.LocalPath != want {
+			t.Errorf("%s LocalPath = %s, want %s", name, f.LocalPath, want)
+		}
+		assertDownloaded(t, want, name)
+	}
+}
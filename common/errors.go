@@ -0,0 +1,129 @@
+package kb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// エラーの種類。errors.Is で判定する
+var (
+	// ErrNotFound : 対象が存在しない(404 / 410)。再試行しない
+	ErrNotFound = errors.New("not found")
+	// ErrThrottled : スロットリング(429 / Retry-After 付きの 503)。再試行する
+	ErrThrottled = errors.New("throttled")
+	// ErrServer : サーバエラー(5xx)。再試行する
+	ErrServer = errors.New("server error")
+	// ErrNetwork : 接続エラー、タイムアウト、途中切断。再試行する
+	ErrNetwork = errors.New("network error")
+	// ErrParse : レスポンスの解析失敗。再試行しない
+	ErrParse = errors.New("parse failure")
+	// ErrUnexpectedStatus : 上記以外の想定外のステータスコード。再試行しない
+	ErrUnexpectedStatus = errors.New("unexpected status")
+	// ErrNoCatalogHits : カタログの検索結果が0件
+	ErrNoCatalogHits = errors.New("no update found in catalog")
+)
+
+// RequestError : カタログ・ダウンロードの HTTP 呼び出しのエラー
+type RequestError struct {
+	// Kind : エラーの種類(ErrNotFound など)
+	Kind       error
+	Op         string
+	URL        string
+	StatusCode int
+	// RetryAfter : Retry-After ヘッダで指定された待ち時間
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *RequestError) Error() string {
+	msg := fmt.Sprintf("%s: op=[%s], url=[%s]", e.Kind, e.Op, e.URL)
+	if e.StatusCode != 0 {
+		msg += fmt.Sprintf(", status=[%d]", e.StatusCode)
+	}
+	if e.Err != nil {
+		msg += fmt.Sprintf(", error=[%v]", e.Err)
+	}
+	return msg
+}
+
+func (e *RequestError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// IsRetryable : 再試行する価値のあるエラーかどうか
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	return errors.Is(err, ErrThrottled) ||
+		errors.Is(err, ErrServer) ||
+		errors.Is(err, ErrNetwork) ||
+		errors.Is(err, ErrDigestMismatch) ||
+		errors.Is(err, ErrSizeMismatch)
+}
+
+// newTransportError : 接続レベルのエラーを分類する
+func newTransportError(op string, url string, err error) error {
+	// 呼び出し元のキャンセルはそのまま返す
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+	return &RequestError{Kind: ErrNetwork, Op: op, URL: url, Err: err}
+}
+
+// checkResponse : ステータスコードからエラーを分類する。2xx の場合は nil
+func checkResponse(op string, resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	e := &RequestError{
+		Op:         op,
+		URL:        resp.Request.URL.String(),
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		e.Kind = ErrNotFound
+	case resp.StatusCode == http.StatusTooManyRequests:
+		e.Kind = ErrThrottled
+	case resp.StatusCode == http.StatusServiceUnavailable && e.RetryAfter > 0:
+		e.Kind = ErrThrottled
+	case resp.StatusCode >= 500:
+		e.Kind = ErrServer
+	default:
+		e.Kind = ErrUnexpectedStatus
+	}
+	return e
+}
+
+// newParseError : レスポンスの解析失敗
+func newParseError(op string, url string, err error) error {
+	return &RequestError{Kind: ErrParse, Op: op, URL: url, Err: err}
+}
+
+// parseRetryAfter : Retry-After ヘッダ(秒数 または HTTP 日付)を解析する
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if sec, err := strconv.Atoi(v); err == nil && sec > 0 {
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,304 @@
+package kb
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ExportFormat : メタデータの出力形式
+type ExportFormat string
+
+const (
+	// FormatCSV : 1ファイル1行の CSV
+	FormatCSV ExportFormat = "csv"
+	// FormatJSON : 1ファイル1要素の JSON 配列
+	FormatJSON ExportFormat = "json"
+	// FormatNDJSON : 1ファイル1行の JSON(改行区切り)
+	FormatNDJSON ExportFormat = "ndjson"
+)
+
+// ParseExportFormat : 出力形式の名前(csv, json, ndjson)を解析する
+func ParseExportFormat(v string) (ExportFormat, error) {
+	switch format := ExportFormat(strings.ToLower(strings.TrimSpace(v))); format {
+	case FormatCSV, FormatJSON, FormatNDJSON:
+		return format, nil
+	}
+	return "", fmt.Errorf("invalid format: %s(csv, json, ndjson)", v)
+}
+
+// ExportOptions : メタデータの出力オプション
+type ExportOptions struct {
+	Format ExportFormat
+	// Columns : CSV の列(MetadataColumnNames の名前)と順序。nil の場合は DefaultMetadataColumns
+	Columns []string
+	// Excel : CSV の先頭に UTF-8 の BOM を付け、改行を CRLF にする(Excel で日本語が文字化けしないように)
+	Excel bool
+}
+
+// metadataRow : メタデータの1行(1ファイル)
+type metadataRow struct {
+	kb   *KB
+	pkg  *PackageInfo
+	file *PackageFile
+	// filtered : 絞り込み条件で対象外になった理由
+	filtered string
+}
+
+// metadataRows : メタデータを1ファイル1行にする。絞り込み条件で対象外になったパッケージは各 KB の最後に含める
+func (kbList KBList) metadataRows() []metadataRow {
+	rows := []metadataRow{}
+	for _, kb := range kbList.KBs() {
+		add := func(pkg *PackageInfo, filtered string) {
+			for _, file := range pkg.Files {
+				rows = append(rows, metadataRow{kb: kb, pkg: pkg, file: file, filtered: filtered})
+			}
+		}
+		for _, pkg := range kb.PackageInfos {
+			add(pkg, "")
+		}
+		for _, filtered := range kb.Filtered {
+			add(filtered.Package, filtered.Reason)
+		}
+	}
+	return rows
+}
+
+// status : ファイルの状態の名前(RunSummary と同じ)
+func (r metadataRow) status() string {
+	if r.filtered != "" {
+		return fileStatusName(StatusFiltered)
+	}
+	return fileStatusName(r.file.Status)
+}
+
+// details : 詳細ページの情報。未取得の場合は空の値
+func (r metadataRow) details() *UpdateDetails {
+	if r.pkg.Details == nil {
+		return &UpdateDetails{}
+	}
+	return r.pkg.Details
+}
+
+// article : KB の記事の情報。未取得の場合は空の値
+func (r metadataRow) article() *KBArticle {
+	if r.kb.Article == nil {
+		return &KBArticle{}
+	}
+	return r.kb.Article
+}
+
+// metadataColumn : CSV の列
+type metadataColumn struct {
+	name  string
+	value func(r metadataRow) string
+}
+
+// metadataColumns : 選択できる CSV の列
+var metadataColumns = []metadataColumn{
+	{"KB", func(r metadataRow) string { return strconv.Itoa(r.kb.no) }},
+	{"KBTitle", func(r metadataRow) string { return r.article().Title }},
+	{"KBReleaseDate", func(r metadataRow) string { return formatDate(r.article().ReleaseDate) }},
+	{"KBAppliesTo", func(r metadataRow) string { return strings.Join(r.article().AppliesTo, "; ") }},
+	{"KBArticleURL", func(r metadataRow) string { return r.article().URL }},
+	{"Query", func(r metadataRow) string { return r.kb.query }},
+	{"PackageTitle", func(r metadataRow) string { return r.pkg.Title }},
+	{"UpdateID", func(r metadataRow) string { return r.pkg.UpdateID }},
+	{"Architecture", func(r metadataRow) string { return r.file.Architecture }},
+	{"Filename", func(r metadataRow) string { return r.file.FileName }},
+	{"Language", func(r metadataRow) string { return r.file.Language }},
+	{"Filesize(bytes)", func(r metadataRow) string { return strconv.FormatInt(r.file.FileSize, 10) }},
+	{"Packagelink", func(r metadataRow) string { return r.file.DownloadLink }},
+	{"Digest", func(r metadataRow) string { return r.file.Digest }},
+	{"DigestAlgorithm", func(r metadataRow) string { algorithm, _ := digestHex(r.file.Digest); return algorithm }},
+	{"DigestHex", func(r metadataRow) string { _, v := digestHex(r.file.Digest); return v }},
+	{"MD5", func(r metadataRow) string { return r.file.MD5hash }},
+	{"Products", func(r metadataRow) string { return r.pkg.Products }},
+	{"Classification", func(r metadataRow) string { return r.pkg.Classification }},
+	{"LastUpdated", func(r metadataRow) string { return formatDate(r.pkg.LastUpdated) }},
+	{"Version", func(r metadataRow) string { return r.pkg.Version }},
+	{"CatalogSize(bytes)", func(r metadataRow) string { return strconv.FormatInt(r.pkg.CatalogSize, 10) }},
+	{"MSRCNumber", func(r metadataRow) string { return r.details().MSRCNumber }},
+	{"MSRCSeverity", func(r metadataRow) string { return r.details().MSRCSeverity }},
+	{"RebootBehavior", func(r metadataRow) string { return r.details().RebootBehavior }},
+	{"RequestsUserInput", func(r metadataRow) string { return formatDetailsBool(r.pkg.Details, r.details().RequestsUserInput) }},
+	{"Uninstallable", func(r metadataRow) string { return formatDetailsBool(r.pkg.Details, r.details().Uninstallable) }},
+	{"SupportURL", func(r metadataRow) string { return r.details().SupportURL }},
+	{"Supersedes", func(r metadataRow) string { return joinUpdateTitles(r.details().Supersedes) }},
+	{"SupersededBy", func(r metadataRow) string { return joinUpdateTitles(r.details().SupersededBy) }},
+	{"LocalPath", func(r metadataRow) string { return r.file.LocalPath }},
+	{"Status", metadataRow.status},
+	{"Filtered", func(r metadataRow) string { return r.filtered }},
+}
+
+// DefaultMetadataColumns : 既定の CSV の列
+var DefaultMetadataColumns = []string{"KB", "KBTitle", "KBReleaseDate", "KBAppliesTo", "PackageTitle", "Architecture", "Filename", "Language", "Filesize(bytes)", "Packagelink", "Digest", "Products", "Classification", "LastUpdated", "Version",
+	"MSRCNumber", "MSRCSeverity", "RebootBehavior", "RequestsUserInput", "Uninstallable", "SupportURL", "Supersedes", "SupersededBy", "Filtered"}
+
+// MetadataColumnNames : 選択できる CSV の列の名前
+func MetadataColumnNames() []string {
+	names := make([]string, len(metadataColumns))
+	for i, column := range metadataColumns {
+		names[i] = column.name
+	}
+	return names
+}
+
+// ParseMetadataColumns : カンマ区切りの列の名前(大文字・小文字は区別しない)を解析する。空の場合は nil
+func ParseMetadataColumns(v string) ([]string, error) {
+	if strings.TrimSpace(v) == "" {
+		return nil, nil
+	}
+	names := []string{}
+	for _, name := range strings.Split(v, ",") {
+		column, err := findMetadataColumn(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, column.name)
+	}
+	return names, nil
+}
+
+func findMetadataColumn(name string) (metadataColumn, error) {
+	for _, column := range metadataColumns {
+		if strings.EqualFold(column.name, name) {
+			return column, nil
+		}
+	}
+	return metadataColumn{}, fmt.Errorf("unknown column: %s(%s)", name, strings.Join(MetadataColumnNames(), ", "))
+}
+
+// formatDetailsBool : 詳細ページの真偽値。未取得の場合は空文字
+func formatDetailsBool(details *UpdateDetails, v bool) string {
+	if details == nil {
+		return ""
+	}
+	return strconv.FormatBool(v)
+}
+
+// digestHex : ダイジェストのアルゴリズムと16進数表記。解析できない場合は空文字
+func digestHex(digest string) (string, string) {
+	if digest == "" {
+		return "", ""
+	}
+	sum, algorithm, _, err := parseDigest(digest)
+	if err != nil {
+		return "", ""
+	}
+	return algorithm, hex.EncodeToString(sum)
+}
+
+// ExportMetadataToCSV : メタデータを1ファイル1行の CSV で w に出力する
+func (kbList KBList) ExportMetadataToCSV(ctx context.Context, w io.Writer, opts ExportOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	names := opts.Columns
+	if names == nil {
+		names = DefaultMetadataColumns
+	}
+	columns := make([]metadataColumn, len(names))
+	header := make([]string, len(names))
+	for i, name := range names {
+		column, err := findMetadataColumn(name)
+		if err != nil {
+			return err
+		}
+		columns[i], header[i] = column, column.name
+	}
+
+	if opts.Excel {
+		if _, err := io.WriteString(w, "\ufeff"); err != nil {
+			return err
+		}
+	}
+	writer := csv.NewWriter(w)
+	writer.UseCRLF = opts.Excel
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	for _, row := range kbList.metadataRows() {
+		record := make([]string, len(columns))
+		for i, column := range columns {
+			record[i] = column.value(row)
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// metadataRecord : JSON, NDJSON で出力するメタデータ。CSV の1行に相当する
+type metadataRecord struct {
+	KB             int            `json:"kb"`
+	KBTitle        string         `json:"kbTitle,omitempty"`
+	KBReleaseDate  string         `json:"kbReleaseDate,omitempty"`
+	KBAppliesTo    []string       `json:"kbAppliesTo,omitempty"`
+	KBArticleURL   string         `json:"kbArticleUrl,omitempty"`
+	Query          string         `json:"query,omitempty"`
+	PackageTitle   string         `json:"packageTitle"`
+	UpdateID       string         `json:"updateId"`
+	Architecture   string         `json:"architecture"`
+	FileName       string         `json:"fileName"`
+	Language       string         `json:"language"`
+	FileSize       int64          `json:"fileSize"`
+	DownloadLink   string         `json:"downloadLink"`
+	Digest         string         `json:"digest"`
+	Products       string         `json:"products"`
+	Classification string         `json:"classification"`
+	LastUpdated    string         `json:"lastUpdated,omitempty"`
+	Version        string         `json:"version,omitempty"`
+	Details        *UpdateDetails `json:"details,omitempty"`
+	LocalPath      string         `json:"localPath,omitempty"`
+	Status         string         `json:"status"`
+	// Filtered : 絞り込み条件で対象外になった理由
+	Filtered string `json:"filtered,omitempty"`
+}
+
+// metadataRecords : JSON, NDJSON で出力するメタデータ
+func (kbList KBList) metadataRecords() []metadataRecord {
+	records := []metadataRecord{}
+	for _, r := range kbList.metadataRows() {
+		records = append(records, metadataRecord{
+			KB: r.kb.no, KBTitle: r.article().Title, KBReleaseDate: formatDate(r.article().ReleaseDate), KBAppliesTo: r.article().AppliesTo, KBArticleURL: r.article().URL,
+			Query: r.kb.query, PackageTitle: r.pkg.Title, UpdateID: r.pkg.UpdateID,
+			Architecture: r.file.Architecture, FileName: r.file.FileName, Language: r.file.Language, FileSize: r.file.FileSize,
+			DownloadLink: r.file.DownloadLink, Digest: r.file.Digest,
+			Products: r.pkg.Products, Classification: r.pkg.Classification, LastUpdated: formatDate(r.pkg.LastUpdated), Version: r.pkg.Version,
+			Details: r.pkg.Details, LocalPath: r.file.LocalPath, Status: r.status(), Filtered: r.filtered,
+		})
+	}
+	return records
+}
+
+// ExportMetadata : メタデータを opts.Format の形式で w に出力する。Columns, Excel は CSV の場合のみ有効
+func (kbList KBList) ExportMetadata(ctx context.Context, w io.Writer, opts ExportOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	switch opts.Format {
+	case FormatCSV, "":
+		return kbList.ExportMetadataToCSV(ctx, w, opts)
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(kbList.metadataRecords())
+	case FormatNDJSON:
+		encoder := json.NewEncoder(w)
+		for _, record := range kbList.metadataRecords() {
+			if err := encoder.Encode(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid format: %s", opts.Format)
+}
@@ -0,0 +1,252 @@
+package kb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestExportList : 偽サーバから KB4103723 を x64 で絞り込んで取得する(x64 は対象、x86 は対象外)
+func newTestExportList(t *testing.T) *KBList {
+	t.Helper()
+	newTestCatalog(t)
+	filter, err := ParseFilter("arch=x64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := NewKBList(context.Background(), []KBSpec{{No: 4103723}}, 2, BuildOptions{Filter: filter})
+	if err != nil {
+		t.Fatalf("NewKBList error = %v", err)
+	}
+	return list
+}
+
+// TestParseExportFormat : 出力形式の名前(大文字小文字、前後の空白は無視)
+func TestParseExportFormat(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ExportFormat
+		wantErr bool
+	}{
+		{in: "csv", want: FormatCSV},
+		{in: " JSON ", want: FormatJSON},
+		{in: "NdJson", want: FormatNDJSON},
+		{in: "", wantErr: true},
+		{in: "xml", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseExportFormat(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseExportFormat(%q) = (%q, %v), want (%q, wantErr %t)", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// csvColumn : CSV のヘッダから列の番号を探す
+func csvColumn(t *testing.T, header []string, name string) int {
+	t.Helper()
+	for i, v := range header {
+		if v == name {
+			return i
+		}
+	}
+	t.Fatalf("column %s not found: %v", name, header)
+	return -1
+}
+
+// TestExportMetadata : 1ファイル1件で出力し、対象外のパッケージは最後に理由とともに出力する
+func TestExportMetadata(t *testing.T) {
+	list := newTestExportList(t)
+
+	// 出力形式ごとに、1ファイル1件の (ファイル名, 対象外の理由) を取り出す
+	type row struct{ fileName, filtered string }
+	wantStatus := func(t *testing.T, r row, status string) {
+		if want := map[bool]string{true: "filtered", false: "pending"}[r.filtered != ""]; status != want {
+			t.Errorf("%s status = %s, want %s", r.fileName, status, want)
+		}
+	}
+	decode := map[ExportFormat]func(t *testing.T, b []byte) []row{
+		FormatJSON: func(t *testing.T, b []byte) []row {
+			records := []metadataRecord{}
+			if err := json.Unmarshal(b, &records); err != nil {
+				t.Fatalf("JSON: %v", err)
+			}
+			rows := []row{}
+			for _, r := range records {
+				if r.KB != 4103723 || r.UpdateID == "" || r.Digest == "" {
+					t.Errorf("record = %+v", r)
+				}
+				rows = append(rows, row{r.FileName, r.Filtered})
+				wantStatus(t, rows[len(rows)-1], r.Status)
+			}
+			return rows
+		},
+		FormatNDJSON: func(t *testing.T, b []byte) []row {
+			rows := []row{}
+			scanner := bufio.NewScanner(bytes.NewReader(b))
+			for scanner.Scan() {
+				r := metadataRecord{}
+				if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+					t.Fatalf("NDJSON line %q: %v", scanner.Text(), err)
+				}
+				rows = append(rows, row{r.FileName, r.Filtered})
+			}
+			return rows
+		},
+		FormatCSV: func(t *testing.T, b []byte) []row {
+			records, err := csv.NewReader(bytes.NewReader(b)).ReadAll()
+			if err != nil {
+				t.Fatalf("CSV: %v", err)
+			}
+			// 既定の列
+			header := records[0]
+			if !reflect.DeepEqual(header, DefaultMetadataColumns) {
+				t.Errorf("CSV header = %v, want %v", header, DefaultMetadataColumns)
+			}
+			name, filtered := csvColumn(t, header, "Filename"), csvColumn(t, header, "Filtered")
+			rows := []row{}
+			for _, r := range records[1:] {
+				rows = append(rows, row{r[name], r[filtered]})
+			}
+			return rows
+		},
+	}
+	want := []row{
+		{testMsuName, ""},
+		{"windows10.0-kb4103723-x86_8b1d0c9e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b2c.msu", "not matched filter [arch=x64]"},
+		{testPsfName, "not matched filter [arch=x64]"},
+	}
+	for format, decode := range decode {
+		t.Run(string(format), func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			if err := list.ExportMetadata(context.Background(), buf, ExportOptions{Format: format}); err != nil {
+				t.Fatalf("ExportMetadata error = %v", err)
+			}
+			got := decode(t, buf.Bytes())
+			if len(got) != len(want) {
+				t.Fatalf("rows = %v, want %v", got, want)
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Errorf("rows[%d] = %v, want %v", i, got[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+// TestExportMetadataInvalidFormat : 不明な出力形式はエラー
+func TestExportMetadataInvalidFormat(t *testing.T) {
+	list := newTestExportList(t)
+
+	if err := list.ExportMetadata(context.Background(), &bytes.Buffer{}, ExportOptions{Format: ExportFormat("xml")}); err == nil {
+		t.Error("ExportMetadata error = nil, want error")
+	}
+}
+
+// TestParseMetadataColumns : 列の名前は大文字小文字を区別せず、正式な名前にする
+func TestParseMetadataColumns(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{in: "", want: nil},
+		{in: "kb, filename ,DIGESTHEX", want: []string{"KB", "Filename", "DigestHex"}},
+		{in: "status,Filtered,localpath", want: []string{"Status", "Filtered", "LocalPath"}},
+		{in: "KB,Size", wantErr: true},
+		{in: "KB,", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseMetadataColumns(tt.in)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseMetadataColumns(%q) = (%v, %v), want (%v, wantErr %t)", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// TestExportMetadataToCSVColumns : 指定した列のみを指定した順序で出力する
+func TestExportMetadataToCSVColumns(t *testing.T) {
+	list := newTestExportList(t)
+
+	buf := &bytes.Buffer{}
+	opts := ExportOptions{Columns: []string{"filename", "DigestAlgorithm", "DigestHex", "Status"}}
+	if err := list.ExportMetadataToCSV(context.Background(), buf, opts); err != nil {
+		t.Fatalf("ExportMetadataToCSV error = %v", err)
+	}
+	records, err := csv.NewReader(buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Filename", "DigestAlgorithm", "DigestHex", "Status"}; !reflect.DeepEqual(records[0], want) {
+		t.Errorf("header = %v, want %v", records[0], want)
+	}
+	// msu は SHA1、psf は SHA256 のダイジェスト
+	want := map[string]struct {
+		algorithm string
+		hexLen    int
+		status    string
+	}{
+		testMsuName: {"SHA1", 40, "pending"},
+		"windows10.0-kb4103723-x86_8b1d0c9e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b2c.msu": {"SHA1", 40, "filtered"},
+		testPsfName: {"SHA256", 64, "filtered"},
+	}
+	if len(records) != len(want)+1 {
+		t.Fatalf("rows = %d, want %d", len(records)-1, len(want))
+	}
+	for _, r := range records[1:] {
+		w, ok := want[r[0]]
+		if !ok || r[1] != w.algorithm || len(r[2]) != w.hexLen || r[3] != w.status {
+			t.Errorf("row = %v, want %+v", r, w)
+		}
+	}
+
+	if err := list.ExportMetadataToCSV(context.Background(), &bytes.Buffer{}, ExportOptions{Columns: []string{"KB", "Unknown"}}); err == nil {
+		t.Error("ExportMetadataToCSV(unknown column) error = nil, want error")
+	}
+}
+
+// TestExportMetadataToCSVExcel : Excel 向けは先頭に BOM を付け、改行を CRLF にする
+func TestExportMetadataToCSVExcel(t *testing.T) {
+	list := newTestExportList(t)
+
+	for _, excel := range []bool{false, true} {
+		buf := &bytes.Buffer{}
+		if err := list.ExportMetadataToCSV(context.Background(), buf, ExportOptions{Columns: []string{"KB", "Filename"}, Excel: excel}); err != nil {
+			t.Fatalf("ExportMetadataToCSV(Excel: %t) error = %v", excel, err)
+		}
+		out := buf.String()
+		if got := strings.HasPrefix(out, "\ufeffKB,Filename\r\n"); got != excel {
+			t.Errorf("Excel: %t, output = %q", excel, out)
+		}
+		if !excel && !strings.HasPrefix(out, "KB,Filename\n") {
+			t.Errorf("Excel: false, output = %q", out)
+		}
+		if got := strings.Count(out, "\r\n"); excel && got != 4 {
+			t.Errorf("Excel: true, CRLF lines = %d, want 4", got)
+		}
+	}
+}
+
+// TestReadPackageFilesFromMetadataCSV : 出力した CSV から対象のファイルのみを読み込む
+func TestReadPackageFilesFromMetadataCSV(t *testing.T) {
+	list := newTestExportList(t)
+
+	buf := &bytes.Buffer{}
+	if err := list.ExportMetadataToCSV(context.Background(), buf, ExportOptions{Excel: true}); err != nil {
+		t.Fatalf("ExportMetadataToCSV error = %v", err)
+	}
+	files, err := ReadPackageFilesFromMetadataCSV(buf)
+	if err != nil {
+		t.Fatalf("ReadPackageFilesFromMetadataCSV error = %v", err)
+	}
+	want := testFile(t, list, testMsuName)
+	if len(files) != 1 || files[0].FileName != want.FileName || files[0].FileSize != want.FileSize || files[0].Digest != want.Digest {
+		t.Errorf("files = %+v, want [%s]", files, testMsuName)
+	}
+}
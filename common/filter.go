@@ -0,0 +1,255 @@
+package kb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// Filter : パッケージの絞り込み条件
+//
+// 条件は ; 区切りで、全ての条件を満たすパッケージが対象になる
+//
+//	arch=x64; lang=en-us,ja-jp; product=Windows Server 2019,Windows Server 2022; title!~Preview
+//
+// 演算子
+//   - 項目=値1,値2 : いずれかの値に一致するパッケージを対象にする
+//   - 項目!=値1,値2 : いずれかの値に一致するパッケージを除外する
+//   - 項目~正規表現 : 正規表現(大文字小文字を区別しない)に一致するパッケージを対象にする
+//   - 項目!~正規表現 : 正規表現に一致するパッケージを除外する
+//
+// 項目
+//   - arch : ファイルのアーキテクチャ(x64 / amd64 は同じ扱い)
+//   - lang : ファイルの言語。= の場合、言語指定のないファイルは全言語共通とみなす
+//   - product : 製品(検索結果の Products 列、なければタイトル)。= は部分一致
+//   - classification : 分類(Security Updates など)
+//   - title : タイトル。= は部分一致
+//   - file : ファイル名
+type Filter struct {
+	expr  string
+	terms []filterTerm
+}
+
+// filterTerm : 絞り込み条件の1項目
+type filterTerm struct {
+	field   string
+	op      string
+	values  []string
+	pattern *regexp.Regexp
+	text    string
+}
+
+// filterFieldAliases : 絞り込み条件の項目名の別名
+var filterFieldAliases = map[string]string{
+	"arch":           "arch",
+	"architecture":   "arch",
+	"lang":           "lang",
+	"language":       "lang",
+	"product":        "product",
+	"products":       "product",
+	"class":          "classification",
+	"classification": "classification",
+	"title":          "title",
+	"file":           "file",
+	"filename":       "file",
+}
+
+// ErrInvalidFilter : 絞り込み条件の書式の誤り
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// filterOperators : 演算子(長いものから判定する)
+var filterOperators = []string{"!~", "!=", "~", "="}
+
+// ParseFilter : 絞り込み条件の文字列を解析する。空文字の場合は nil(絞り込みなし)
+func ParseFilter(expr string) (*Filter, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, nil
+	}
+	f := &Filter{expr: strings.TrimSpace(expr)}
+	for _, text := range strings.Split(expr, ";") {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		term, err := parseFilterTerm(text)
+		if err != nil {
+			return nil, err
+		}
+		f.terms = append(f.terms, term)
+	}
+	return f, nil
+}
+
+func parseFilterTerm(text string) (filterTerm, error) {
+	idx := strings.IndexAny(text, "!=~")
+	if idx < 0 {
+		return filterTerm{}, fmt.Errorf("%w: operator not found: term=[%s]", ErrInvalidFilter, text)
+	}
+	key := strings.ToLower(strings.TrimSpace(text[:idx]))
+	field, ok := filterFieldAliases[key]
+	if !ok {
+		return filterTerm{}, fmt.Errorf("%w: unknown field: term=[%s], field=[%s]", ErrInvalidFilter, text, key)
+	}
+	term := filterTerm{field: field, text: text}
+	rest := text[idx:]
+	for _, op := range filterOperators {
+		if strings.HasPrefix(rest, op) {
+			term.op = op
+			break
+		}
+	}
+	if term.op == "" {
+		return filterTerm{}, fmt.Errorf("%w: unknown operator: term=[%s]", ErrInvalidFilter, text)
+	}
+	value := strings.TrimSpace(rest[len(term.op):])
+	if value == "" {
+		return filterTerm{}, fmt.Errorf("%w: value is empty: term=[%s]", ErrInvalidFilter, text)
+	}
+	if strings.HasSuffix(term.op, "~") {
+		pattern, err := regexp.Compile("(?i)" + value)
+		if err != nil {
+			return filterTerm{}, fmt.Errorf("%w: term=[%s]: %w", ErrInvalidFilter, text, err)
+		}
+		term.pattern = pattern
+		return term, nil
+	}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			term.values = append(term.values, v)
+		}
+	}
+	return term, nil
+}
+
+// String : 絞り込み条件の文字列
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.expr
+}
+
+// Evaluate : パッケージが絞り込み条件を満たすかどうか。満たさない場合は理由を返す
+func (f *Filter) Evaluate(p *PackageInfo) (bool, string) {
+	if f == nil {
+		return true, ""
+	}
+	for _, term := range f.terms {
+		matched := term.match(p)
+		exclude := strings.HasPrefix(term.op, "!")
+		if exclude && matched {
+			return false, fmt.Sprintf("excluded by filter [%s]", term.text)
+		}
+		if !exclude && !matched {
+			return false, fmt.Sprintf("not matched filter [%s]", term.text)
+		}
+	}
+	return true, ""
+}
+
+// match : 項目が値(または正規表現)に一致するかどうか。演算子の否定は考慮しない
+func (term filterTerm) match(p *PackageInfo) bool {
+	if term.pattern != nil {
+		for _, v := range term.targets(p) {
+			if term.pattern.MatchString(v) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, v := range term.values {
+		if term.matchValue(p, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchValue : 項目が値に一致するかどうか
+func (term filterTerm) matchValue(p *PackageInfo, v string) bool {
+	switch term.field {
+	case "arch":
+		return matchArchitecture(p, v)
+	case "lang":
+		// 除外の場合、言語指定のないファイルは一致とみなさない
+		if term.op == "!=" {
+			for _, file := range p.Files {
+				if strings.EqualFold(file.Language, v) {
+					return true
+				}
+			}
+			return false
+		}
+		return matchLanguage(p, v)
+	case "product", "title":
+		for _, target := range term.targets(p) {
+			if strings.Contains(strings.ToLower(target), strings.ToLower(v)) {
+				return true
+			}
+		}
+		return false
+	default:
+		for _, target := range term.targets(p) {
+			if strings.EqualFold(target, v) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// targets : 正規表現・文字列の比較対象となる値
+func (term filterTerm) targets(p *PackageInfo) []string {
+	switch term.field {
+	case "arch":
+		values := []string{}
+		for _, file := range p.Files {
+			values = append(values, file.Architecture)
+		}
+		return values
+	case "lang":
+		values := []string{}
+		for _, file := range p.Files {
+			values = append(values, file.Language)
+		}
+		return values
+	case "product":
+		if p.Products == "" {
+			return []string{p.Title}
+		}
+		return []string{p.Products}
+	case "classification":
+		return []string{p.Classification}
+	case "title":
+		return []string{p.Title}
+	case "file":
+		values := []string{}
+		for _, file := range p.Files {
+			values = append(values, file.FileName)
+		}
+		return values
+	}
+	return nil
+}
+
+// FilteredPackage : 絞り込み条件で対象外になったパッケージと理由
+type FilteredPackage struct {
+	Package *PackageInfo
+	Reason  string
+}
+
+// applyFilter : 条件を満たさないパッケージを KB のパッケージの一覧から除き、理由とともに Filtered に記録する
+func (kb *KB) applyFilter(match func(p *PackageInfo) (bool, string)) {
+	pkgs := []*PackageInfo{}
+	for _, p := range kb.PackageInfos {
+		if ok, reason := match(p); !ok {
+			log.Printf("Package filtered: kb=[%d], title=[%s], reason=[%s]", kb.no, p.Title, reason)
+			kb.Filtered = append(kb.Filtered, &FilteredPackage{Package: p, Reason: reason})
+			continue
+		}
+		pkgs = append(pkgs, p)
+	}
+	kb.PackageInfos = pkgs
+}
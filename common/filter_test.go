@@ -0,0 +1,127 @@
+package kb
+
+import (
+	"errors"
+	"testing"
+)
+
+// testFilterPackage : 絞り込み条件のテスト用のパッケージ
+func testFilterPackage() *PackageInfo {
+	return &PackageInfo{
+		Title:          "2019-10 Cumulative Update Preview for Windows Server 2019 for x64-based Systems (KB4520062)",
+		Products:       "Windows Server 2019",
+		Classification: "Updates",
+		Files: []*PackageFile{
+			{FileName: "windows10.0-kb4520062-x64_en-us.cab", Architecture: "AMD64", Language: "en-us"},
+			{FileName: "windows10.0-kb4520062-x64.msu", Architecture: "AMD64"},
+		},
+	}
+}
+
+// TestFilterEvaluate : 演算子(=, !=, ~, !~)、項目の別名、アーキテクチャの別名、言語指定のないファイル
+func TestFilterEvaluate(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{expr: "", want: true},
+		{expr: "arch=x64", want: true},
+		{expr: "arch=amd64", want: true},
+		{expr: "Architecture = X64", want: true},
+		{expr: "arch=x86,arm64", want: false},
+		{expr: "arch!=x86", want: true},
+		{expr: "arch!=x64", want: false},
+		// 言語指定のないファイルは全言語共通とみなす
+		{expr: "lang=ja-jp", want: true},
+		// 除外の場合、言語指定のないファイルは一致とみなさない
+		{expr: "lang!=ja-jp", want: true},
+		{expr: "lang!=EN-US", want: false},
+		{expr: "product=server 2019", want: true},
+		{expr: "products=Windows 10,Windows Server 2022", want: false},
+		{expr: "class=updates", want: true},
+		{expr: "classification=Security Updates", want: false},
+		{expr: "title~preview", want: true},
+		{expr: "title!~Preview", want: false},
+		{expr: "title!~^Security", want: true},
+		{expr: "file~\\.msu$", want: true},
+		{expr: "filename=windows10.0-kb4520062-x64.msu", want: true},
+		{expr: "file=windows10.0-kb4520062-x86.msu", want: false},
+		// 全ての条件を満たす場合のみ対象
+		{expr: "arch=x64; lang=en-us ; title!~Preview", want: false},
+		{expr: "arch=x64;;product=Windows Server 2019;", want: true},
+	}
+	p := testFilterPackage()
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.expr)
+		if err != nil {
+			t.Errorf("ParseFilter(%q) error = %v", tt.expr, err)
+			continue
+		}
+		got, reason := f.Evaluate(p)
+		if got != tt.want {
+			t.Errorf("Evaluate(%q) = %t(%s), want %t", tt.expr, got, reason, tt.want)
+		}
+		if got == (reason != "") {
+			t.Errorf("Evaluate(%q) reason = %q", tt.expr, reason)
+		}
+	}
+}
+
+// TestFilterEvaluateNoFileInfo : ファイルにアーキテクチャの記載がない場合はタイトルから判断する
+// 商品名がない場合はタイトルを製品とみなす
+func TestFilterEvaluateNoFileInfo(t *testing.T) {
+	p := &PackageInfo{
+		Title: "2018-05 Cumulative Update for Windows 10 Version 1607 for x86-based Systems (KB4103723)",
+		Files: []*PackageFile{{FileName: "windows10.0-kb4103723-x86.msu"}},
+	}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{expr: "arch=x86", want: true},
+		{expr: "arch=x64", want: false},
+		{expr: "product=Windows 10 Version 1607", want: true},
+		{expr: "lang=ja-jp", want: true},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseFilter(%q) error = %v", tt.expr, err)
+		}
+		if got, reason := f.Evaluate(p); got != tt.want {
+			t.Errorf("Evaluate(%q) = %t(%s), want %t", tt.expr, got, reason, tt.want)
+		}
+	}
+}
+
+// TestParseFilterError : 演算子、項目名、値、正規表現の誤り
+func TestParseFilterError(t *testing.T) {
+	for _, expr := range []string{
+		"arch",
+		"os=windows",
+		"arch=",
+		"title~(",
+		"arch=x64; lang",
+	} {
+		if f, err := ParseFilter(expr); !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("ParseFilter(%q) = (%v, %v), want %v", expr, f, err, ErrInvalidFilter)
+		}
+	}
+}
+
+// TestParseFilterEmpty : 空の条件は絞り込みなし(nil)
+func TestParseFilterEmpty(t *testing.T) {
+	for _, expr := range []string{"", "  "} {
+		f, err := ParseFilter(expr)
+		if err != nil || f != nil {
+			t.Errorf("ParseFilter(%q) = (%v, %v), want (nil, nil)", expr, f, err)
+		}
+		if f.String() != "" {
+			t.Errorf("String() = %q, want empty", f.String())
+		}
+	}
+	f, _ := ParseFilter(" arch=x64; lang=ja-jp ")
+	if got := f.String(); got != "arch=x64; lang=ja-jp" {
+		t.Errorf("String() = %q", got)
+	}
+}
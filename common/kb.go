@@ -1,112 +1,248 @@
 package kb
 
 import (
+	"context"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
-	"net/http"
-	"net/url"
 	"os"
-	"regexp"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
-
-	"github.com/PuerkitoBio/goquery"
+	"time"
 )
 
+// KBList : 指定された KB の取得結果の一覧。指定された順序を保持する
 type KBList struct {
-	kbs []KB
+	results []KBResult
+}
+
+// KBResult : KB 単位の取得結果。取得に失敗した場合は Err が設定される
+// 検索語で取得した場合は Query が設定される。検索に失敗した場合、No は 0
+type KBResult struct {
+	No    int
+	Query string
+	KB    *KB
+	Err   error
 }
 
 type KB struct {
-	no           int
-	title        string
+	no int
+	// hits : カタログの検索結果の総件数
+	hits int
+	// query : 検索語で取得した場合の検索語
+	query        string
 	PackageInfos []*PackageInfo
+	// Filtered : 絞り込み条件で対象外になったパッケージ。ダウンロード・アップロードしない
+	Filtered []*FilteredPackage
+	// Article : サポート技術情報の KB の記事。BuildOptions.Article を指定しない場合、記事が存在しない場合は nil
+	Article *KBArticle
 }
 
+// PackageInfo : カタログ上の1つの更新プログラム。複数のファイルで構成される場合がある
 type PackageInfo struct {
-	Title        string
+	Title    string
+	UpdateID string
+	// 以下は検索結果の一覧の列
+	Products       string
+	Classification string
+	LastUpdated    time.Time
+	Version        string
+	// CatalogSize : カタログに表示されている合計サイズ(バイト)
+	CatalogSize int64
+	// Details : 詳細ページの情報。BuildOptions.Details を指定しない場合は nil
+	Details *UpdateDetails
+	Files   []*PackageFile
+}
+
+// PackageFile : 更新プログラムを構成する個々のファイル
+type PackageFile struct {
 	DownloadLink string
 	Architecture string
 	FileName     string
 	Language     string
 	FileSize     int64
+	Digest       string
 	Status       int
 	MD5hash      string
+	// LocalPath : ダウンロード先のパス。ダウンロード(既存ファイルによるスキップを含む)に成功した場合に設定される
+	LocalPath string
 }
 
-const (
-	catalogURL        = "https://www.catalog.update.microsoft.com/Search.aspx?q=%d"
-	kbsiteURL         = "https://support.microsoft.com/en-us/help/%d"
-	downloadDialogURL = "https://www.catalog.update.microsoft.com/DownloadDialog.aspx"
-)
+// BuildOptions : KB 情報の取得オプション
+type BuildOptions struct {
+	// Details : 更新プログラムごとに詳細ページ(置き換え関係、MSRC の深刻度、再起動の要否など)も取得する
+	Details bool
+	// Filter : パッケージの絞り込み条件。nil の場合は全てのパッケージが対象
+	Filter *Filter
+	// Article : サポート技術情報から KB の記事(タイトル、公開日、適用対象)も取得する
+	Article bool
+}
 
-// ExportMetadataToCSV : メタデータを CSV にエクスポートする
-func (kbList KBList) ExportMetadataToCSV() error {
-	file, err := os.Create("metadata.csv")
+// ReadPackageFilesFromMetadataCSV : ExportMetadataToCSV で出力した CSV から、ファイル名、サイズ、ダイジェストを読み込む(Filename, Digest または DigestHex 列が必要)
+// 絞り込み条件で対象外になった行は含めない。同じファイル名の行は1つにまとめる
+func ReadPackageFilesFromMetadataCSV(r io.Reader) ([]*PackageFile, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
 	if err != nil {
-		log.Fatal(err)
-		return err
+		return nil, fmt.Errorf("metadata CSV has no header: %w", err)
+	}
+	column := func(name string) int {
+		for i, v := range header {
+			if strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(v, "\ufeff")), name) {
+				return i
+			}
+		}
+		return -1
+	}
+	nameIdx, sizeIdx, digestIdx, filteredIdx := column("Filename"), column("Filesize(bytes)"), column("Digest"), column("Filtered")
+	if digestIdx < 0 {
+		// Digest の代わりに DigestHex を選択して出力した CSV
+		digestIdx = column("DigestHex")
+	}
+	if nameIdx < 0 || digestIdx < 0 {
+		return nil, errors.New("metadata CSV must have Filename and Digest(or DigestHex) columns")
 	}
-	defer file.Close()
 
-	writer := csv.NewWriter(file)
-	writer.Write([]string{"KB", "Title(NotImpl)", "PackageTitle", "Architecture", "Filename", "Language", "Filesize(bytes)", "Packagelink"})
-	for _, kb := range kbList.kbs {
-		for _, pkg := range kb.PackageInfos {
-			writer.Write([]string{strconv.Itoa(kb.no), kb.title, pkg.Title, pkg.Architecture, pkg.FileName, pkg.Language, strconv.FormatInt(pkg.FileSize, 10), pkg.DownloadLink})
+	files := []*PackageFile{}
+	seen := map[string]bool{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if field(record, filteredIdx) != "" {
+			continue
+		}
+		name := field(record, nameIdx)
+		if name == "" || seen[name] {
+			continue
 		}
+		seen[name] = true
+		file := &PackageFile{FileName: name, Digest: field(record, digestIdx)}
+		if size, err := strconv.ParseInt(field(record, sizeIdx), 10, 64); err == nil {
+			file.FileSize = size
+		}
+		files = append(files, file)
 	}
-	writer.Flush()
-	return nil
+	return files, nil
+}
+
+// DownloadOptions : ファイルのダウンロードのオプション
+type DownloadOptions struct {
+	// OutDir : 出力先ディレクトリ。空の場合はカレントディレクトリ
+	OutDir string
+	// Layout : 出力先ディレクトリの下の配置。nil の場合は DefaultLayout
+	Layout *Layout
+	// Progress : ダウンロードの進捗の集計。nil の場合は集計しない
+	Progress *Progress
 }
 
 // DownloadAllKB : ファイルのダウンロード
-func (kbList KBList) DownloadAllKB(maxConcurrent int) error {
-	ch := make(chan KB, len(kbList.kbs))
+// ダウンロードに失敗したファイルがあった場合は、全てのエラーをまとめて返す
+func (kbList KBList) DownloadAllKB(ctx context.Context, maxConcurrent int, opts DownloadOptions) error {
+	kbs := kbList.KBs()
+	ch := make(chan *KB, len(kbs))
 	wg := &sync.WaitGroup{}
 	semaphore := make(chan int, maxConcurrent)
+	policy := catalogRetryPolicy()
+	outDir := opts.OutDir
+	if outDir == "" {
+		outDir = "."
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return fmt.Errorf("create output directory: %w", err)
+	}
+	for _, kb := range kbs {
+		for _, kbPackageInfo := range kb.PackageInfos {
+			for _, file := range kbPackageInfo.Files {
+				opts.Progress.Plan(file)
+			}
+		}
+	}
+
+	mu := &sync.Mutex{}
+	errs := []error{}
+	// 同じパスに複数の KB から同時に書き込まないよう、パス単位でロックする
+	pathLocks := map[string]*sync.Mutex{}
+	lockPath := func(filePath string) func() {
+		mu.Lock()
+		l, ok := pathLocks[filePath]
+		if !ok {
+			l = &sync.Mutex{}
+			pathLocks[filePath] = l
+		}
+		mu.Unlock()
+		l.Lock()
+		return l.Unlock
+	}
 
-	for _, kb := range kbList.kbs {
+	for _, kb := range kbs {
 		wg.Add(1)
 		// 同一KBでファイル重複があるため、KB単位でgoroutine
-		go func(kb KB, ch chan KB) {
+		go func(kb *KB, ch chan *KB) {
 			log.Printf("--------------- start download all package : kb=[%d]", kb.no)
 			defer wg.Done()
 			for _, kbPackageInfo := range kb.PackageInfos {
-				err := func() error {
-					semaphore <- 1
-					defer func() { <-semaphore }()
-					// ファイルの存在チェック
-					// ファイルが存在する場合は処理をスキップ(1つのKBで、複数OS分のパッケージがリストされている場合、ファイルが同一の場合がある)
-					if _, err := os.Stat(kbPackageInfo.FileName); err == nil {
-						log.Printf("file is exists. skip.. : kb=[%d], fileName=[%s]", kb.no, kbPackageInfo.FileName)
-						return err
-					}
+				// パッケージ単位の期限
+				ctx, cancel := policy.withPackageTimeout(ctx)
+				for _, file := range kbPackageInfo.Files {
+					err := func() error {
+						relPath, err := opts.Layout.Path(kb, kbPackageInfo, file)
+						if err != nil {
+							file.Status = StatusError
+							return err
+						}
+						filePath := filepath.Join(outDir, relPath)
+						if err := ensureDir(outDir, filepath.Dir(filePath)); err != nil {
+							file.Status = StatusError
+							return err
+						}
 
-					log.Printf("start download KB-Pkg : kb=[%d], fileName=[%s]", kb.no, kbPackageInfo.FileName)
-					resp, err := http.Get(kbPackageInfo.DownloadLink)
-					if err != nil {
-						return err
-					}
-					defer resp.Body.Close()
-					file, err := os.Create(kbPackageInfo.FileName)
+						semaphore <- 1
+						defer func() { <-semaphore }()
+						defer lockPath(filePath)()
+						tr := opts.Progress.Start(kbPackageInfo, file)
+						defer tr.Done()
+						// ファイルの存在チェック
+						// ファイルが存在する場合は処理をスキップ(1つのKBで、複数OS分のパッケージがリストされている場合、ファイルが同一の場合がある)
+						if existsVerifiedFile(file, filePath) {
+							log.Printf("file is exists. skip.. : kb=[%d], filePath=[%s]", kb.no, filePath)
+							file.Status = StatusDownloadSkip
+							file.LocalPath = filePath
+							tr.Set(file.FileSize)
+							return nil
+						}
+
+						// 再試行可能なエラー(ダイジェスト不一致を含む)の場合は再試行
+						return policy.Do(ctx, "download", func(ctx context.Context, attempt int) error {
+							log.Printf("start download KB-Pkg : kb=[%d], fileName=[%s], filePath=[%s], attempt=[%d]", kb.no, file.FileName, filePath, attempt)
+							if err := downloadFile(ctx, file, filePath, tr); err != nil {
+								file.Status = StatusError
+								log.Printf("download error KB-Pkg : kb=[%d], fileName=[%s], attempt=[%d], error=[%v]", kb.no, file.FileName, attempt, err)
+								return err
+							}
+							file.Status = StatusDownloadComplete
+							file.LocalPath = filePath
+							log.Printf("end download KB-Pkg : kb=[%d], fileName=[%s]", kb.no, file.FileName)
+							return nil
+						})
+					}()
 					if err != nil {
-						return err
+						log.Print(err)
+						mu.Lock()
+						errs = append(errs, fmt.Errorf("kb=[%d], fileName=[%s]: %w", kb.no, file.FileName, err))
+						mu.Unlock()
 					}
-					defer file.Close()
-
-					io.Copy(file, resp.Body)
-					log.Printf("end download KB-Pkg : kb=[%d], fileName=[%s]", kb.no, kbPackageInfo.FileName)
-					return nil
-				}()
-				if err != nil {
-					log.Print(err)
 				}
-
+				cancel()
 			}
 			log.Printf("end download KB : kb=[%d]", kb.no)
 			ch <- kb
@@ -115,7 +251,7 @@ func (kbList KBList) DownloadAllKB(maxConcurrent int) error {
 	//wg.Wait()
 	//close(ch)
 
-	for range kbList.kbs {
+	for range kbs {
 		/*
 			for _, p := range k.packageInfos {
 				log.Print(<-p.staus)
@@ -125,117 +261,163 @@ func (kbList KBList) DownloadAllKB(maxConcurrent int) error {
 	}
 
 	close(ch)
-	return nil
+	return errors.Join(errs...)
 }
 
 // NewKBList : KB番号から、URLやタイトルのリストを生成する
-func NewKBList(nos []int, maxConcurrent int) *KBList {
-	kbList := new(KBList)
+// 同じ KB 番号が複数指定された場合は1つにまとめ、いずれかの絞り込み条件に一致するパッケージを対象とする
+// 結果は指定された順序で格納される。取得に失敗した KB は KBResult.Err に記録し、全てのエラーをまとめたものを返す
+func NewKBList(ctx context.Context, specs []KBSpec, maxConcurrent int, opts BuildOptions) (*KBList, error) {
+	nos, groups := groupKBSpecs(specs)
+	// goroutine ごとに書き込み先のインデックスを分けるため、ロックは不要
+	kbList := &KBList{results: make([]KBResult, len(nos))}
 
 	wg := &sync.WaitGroup{}
 	semaphore := make(chan int, maxConcurrent)
-	for _, no := range nos {
+	for i, no := range nos {
 		wg.Add(1)
-		go func(no int) {
+		go func(i int, no int) {
 			defer wg.Done()
 			semaphore <- 1
-			kbList.kbs = append(kbList.kbs, *BuildKBInfo(no))
-			<-semaphore
-		}(no)
+			defer func() { <-semaphore }()
+			result := KBResult{No: no}
+			kb, err := BuildKBInfo(ctx, no, opts)
+			if err != nil {
+				log.Printf("Build KB information error: kb=[%d], error=[%v]", no, err)
+				result.Err = err
+			} else {
+				kb.applyFilter(matchKBSpecs(groups[no]))
+				result.KB = kb
+			}
+			kbList.results[i] = result
+		}(i, no)
 	}
 	wg.Wait()
-	return kbList
+	return kbList, kbList.Err()
 }
-func BuildKBInfo(no int) *KB {
-	kb := &KB{no: no}
 
-	// -------------------------------------
-	// ToDo KB サイトからタイトル取得
-	// -------------------------------------
+// Results : KB 単位の取得結果(指定された順序)
+func (kbList KBList) Results() []KBResult {
+	return kbList.results
+}
+
+// KBs : 取得に成功した KB の一覧(指定された順序)
+func (kbList KBList) KBs() []*KB {
+	kbs := []*KB{}
+	for _, result := range kbList.results {
+		if result.KB != nil {
+			kbs = append(kbs, result.KB)
+		}
+	}
+	return kbs
+}
+
+// Err : 取得に失敗した KB のエラーをまとめたもの。全て成功した場合は nil
+func (kbList KBList) Err() error {
+	errs := []error{}
+	for _, result := range kbList.results {
+		if result.Err != nil {
+			errs = append(errs, result.Err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// No : KB 番号
+func (kb *KB) No() int {
+	return kb.no
+}
+
+// Hits : カタログの検索結果の総件数(絞り込み前)
+func (kb *KB) Hits() int {
+	return kb.hits
+}
+
+// Query : 検索語で取得した場合の検索語。KB 番号で取得した場合は空
+func (kb *KB) Query() string {
+	return kb.query
+}
+
+// Title : KB のタイトル(サポート技術情報の記事のタイトル)。記事を取得していない場合は空
+func (kb *KB) Title() string {
+	if kb.Article == nil {
+		return ""
+	}
+	return kb.Article.Title
+}
+
+// BuildKBInfo : カタログから KB のパッケージ情報を取得する
+// カタログに1件も存在しない場合は ErrNoCatalogHits を返す
+func BuildKBInfo(ctx context.Context, no int, opts BuildOptions) (*KB, error) {
+	kb := &KB{no: no}
 
 	// -------------------------------------
 	// Windows Update カタログ
 	// -------------------------------------
-	catalogDoc, err := goquery.NewDocument(fmt.Sprintf(catalogURL, kb.no))
+	result, err := DefaultCatalog.Search(ctx, strconv.Itoa(kb.no))
 	if err != nil {
-		log.Print(err)
-		return nil
-	}
-
-	//抜き出してくる文字列:
-	//<a id="ef673d9c-0e61-412b-be87-9eba39fe13dd_link" href="javascript:void(0);" onclick="goToDetails(";ef673d9c-0e61-412b-be87-9eba39fe13dd");">
-	catalogDoc.Find("tbody > tr > td > a").Each(
-		func(_ int, s *goquery.Selection) {
-			packageInfo := PackageInfo{}
-
-			onclick, ok := s.Attr("onclick")
-			if ok && strings.Contains(onclick, "goToDetails") {
-				// goToDetails の ID 部分だけ取得
-				updateID := strings.Replace(
-					strings.Replace(onclick, "goToDetails(\"", "", -1), "\");",
-					"",
-					-1,
-				)
-				packageInfo.Title = strings.TrimSpace(s.Text())
-				log.Printf("Get Package title and Id:packageTitle=[%s], onclick=[%s], updateID=[%s]", packageInfo.Title, onclick, updateID)
-
-				//----------------------------------
-				// scraiping package download link
-				//----------------------------------
-				// Request
-				data := url.Values{}
-				data.Set("updateIDs", fmt.Sprintf(`[{"size":0,"languages":"","uidInfo":"%s","updateID":"%s"}]`, updateID, updateID))
-				req, err := http.NewRequest(
-					"POST",
-					downloadDialogURL,
-					strings.NewReader(data.Encode()),
-				)
-				if err != nil {
-					log.Print(err)
-					return
-				}
-				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return nil, fmt.Errorf("kb=[%d]: %w", no, err)
+	}
+	if len(result.Packages) == 0 {
+		return nil, fmt.Errorf("kb=[%d]: %w", no, ErrNoCatalogHits)
+	}
+	kb.hits = result.Total
+	log.Printf("Search catalog: kb=[%d], total=[%d], pages=[%d], packages=[%d]", no, result.Total, result.Pages, len(result.Packages))
 
-				client := &http.Client{}
+	if err := buildPackages(ctx, result.Packages, opts); err != nil {
+		return nil, fmt.Errorf("kb=[%d], %w", no, err)
+	}
+	kb.PackageInfos = result.Packages
+	kb.applyFilter(opts.Filter.Evaluate)
 
-				// Response
-				resp, err := client.Do(req)
-				if err != nil {
-					log.Print(err)
-					return
-				}
+	// -------------------------------------
+	// サポート技術情報の記事(取得できなくても KB の処理は続ける)
+	// -------------------------------------
+	if opts.Article {
+		kb.Article = fetchArticle(ctx, no)
+	}
+	return kb, nil
+}
 
-				//----------------------------------
-				// scraiping for download dialog
-				//----------------------------------
-				body, _ := ioutil.ReadAll(resp.Body)
-				dialogBodyDoc, err := goquery.NewDocumentFromReader(strings.NewReader(string(body)))
-				if err != nil {
-					log.Print(err)
-					return
-				}
-				html, _ := dialogBodyDoc.Html()
-				r := regexp.MustCompile(`downloadInformation\[0\]\.files\[0\]\.(\S+) = '(\S+)';`)
-				m := map[string]string{}
-				for _, v := range r.FindAllStringSubmatch(html, -1) {
-					m[v[1]] = v[2]
-				}
-				log.Printf("Get file information: m=%s", m)
-				defer resp.Body.Close()
-				// ファイルサイズの取得(HEAD)
-				res, err := http.Head(m["url"])
-				if err != nil {
-					log.Print(err)
-					return
-				}
-				packageInfo.FileSize = res.ContentLength
-				packageInfo.DownloadLink = m["url"]
-				packageInfo.Architecture = m["architectures"]
-				packageInfo.FileName = m["fileName"]
-				packageInfo.Language = m["longLanguages"]
-				kb.PackageInfos = append(kb.PackageInfos, &packageInfo)
+// buildPackages : 検索結果の更新プログラムごとに、ファイルの情報(と詳細ページの情報)を取得する
+func buildPackages(ctx context.Context, pkgs []*PackageInfo, opts BuildOptions) error {
+	for _, packageInfo := range pkgs {
+		//----------------------------------
+		// scraiping package download link
+		//----------------------------------
+		files, err := DefaultCatalog.PackageFiles(ctx, packageInfo.UpdateID)
+		if err != nil {
+			return fmt.Errorf("updateID=[%s]: %w", packageInfo.UpdateID, err)
+		}
+		packageInfo.Files = files
+
+		//----------------------------------
+		// scraiping update details
+		//----------------------------------
+		if opts.Details {
+			details, err := DefaultCatalog.Details(ctx, packageInfo.UpdateID)
+			if err != nil {
+				return fmt.Errorf("updateID=[%s]: %w", packageInfo.UpdateID, err)
 			}
+			packageInfo.Details = details
+		}
+	}
+	return nil
+}
 
-		})
-	return (kb)
+// joinUpdateTitles : 置き換え関係の更新プログラムのタイトルを "; " 区切りでまとめる
+func joinUpdateTitles(refs []UpdateRef) string {
+	titles := make([]string, len(refs))
+	for i, ref := range refs {
+		titles[i] = ref.Title
+	}
+	return strings.Join(titles, "; ")
+}
+
+// formatDate : 日付を YYYY-MM-DD 形式にする。未設定の場合は空文字
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02")
 }
@@ -0,0 +1,118 @@
+package kb
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tsubasaxZZZ/wutools/common/kbtest"
+)
+
+// newTestCatalog : 偽サーバを起動し、DefaultCatalog と DefaultRetryPolicy を偽サーバ向けに差し替える
+// 再試行の待ち時間は短くする。テストの終了時に元に戻す
+func newTestCatalog(t *testing.T) (*kbtest.CatalogServer, *HTTPCatalogClient) {
+	t.Helper()
+	srv := kbtest.NewCatalogServer()
+	catalog, policy := DefaultCatalog, DefaultRetryPolicy
+	t.Cleanup(func() {
+		DefaultCatalog, DefaultRetryPolicy = catalog, policy
+		srv.Close()
+	})
+	client := NewCatalogClient(srv.URL, srv.Client())
+	DefaultCatalog = client
+	DefaultRetryPolicy.MaxAttempts = 3
+	DefaultRetryPolicy.BaseDelay = 10 * time.Millisecond
+	DefaultRetryPolicy.MaxDelay = 50 * time.Millisecond
+	return srv, client
+}
+
+// TestNewKBList : 重複・存在しない KB 番号を含む指定を並行して取得し、指定された順序で結果を返す
+func TestNewKBList(t *testing.T) {
+	newTestCatalog(t)
+
+	specs := []KBSpec{
+		{No: 4103723, Architecture: "x64"},
+		{No: 9999999},
+		{No: 4093105},
+		{No: 4103723, Architecture: "x86"},
+	}
+	list, err := NewKBList(context.Background(), specs, 3, BuildOptions{})
+	if !errors.Is(err, ErrNoCatalogHits) {
+		t.Fatalf("NewKBList error = %v, want %v", err, ErrNoCatalogHits)
+	}
+
+	// 重複した KB は1つにまとめ、最初に現れた順序で返す
+	results := list.Results()
+	wantNos := []int{4103723, 9999999, 4093105}
+	if len(results) != len(wantNos) {
+		t.Fatalf("len(Results()) = %d, want %d", len(results), len(wantNos))
+	}
+	for i, no := range wantNos {
+		if results[i].No != no {
+			t.Errorf("Results()[%d].No = %d, want %d", i, results[i].No, no)
+		}
+	}
+
+	// 取得に失敗した KB はエラーのみ、他の KB は取得できている
+	if results[1].KB != nil || !errors.Is(results[1].Err, ErrNoCatalogHits) {
+		t.Errorf("Results()[1] = {KB: %v, Err: %v}, want {KB: nil, Err: %v}", results[1].KB, results[1].Err, ErrNoCatalogHits)
+	}
+	for _, i := range []int{0, 2} {
+		if results[i].Err != nil || results[i].KB == nil {
+			t.Fatalf("Results()[%d] = {KB: %v, Err: %v}, want KB", i, results[i].KB, results[i].Err)
+		}
+		if got := results[i].KB.No(); got != wantNos[i] {
+			t.Errorf("Results()[%d].KB.No() = %d, want %d", i, got, wantNos[i])
+		}
+	}
+	if kbs := list.KBs(); len(kbs) != 2 || kbs[0].No() != 4103723 || kbs[1].No() != 4093105 {
+		t.Errorf("KBs() = %v, want [4103723 4093105]", kbs)
+	}
+
+	// 重複した KB の絞り込み条件(x64 と x86)はいずれかに一致するパッケージを対象とする
+	if got := len(results[0].KB.PackageInfos); got != 2 {
+		t.Errorf("KB4103723 packages = %d, want 2", got)
+	}
+}
+
+// TestNewKBListFilter : 絞り込み条件に一致しないパッケージは対象外にする
+func TestNewKBListFilter(t *testing.T) {
+	newTestCatalog(t)
+
+	list, err := NewKBList(context.Background(), []KBSpec{{No: 4103723, Architecture: "x64"}}, 2, BuildOptions{})
+	if err != nil {
+		t.Fatalf("NewKBList error = %v", err)
+	}
+	pkgs := list.KBs()[0].PackageInfos
+	if len(pkgs) != 1 || !strings.Contains(pkgs[0].Title, "x64-based") {
+		t.Fatalf("packages = %v, want x64 package only", pkgs)
+	}
+	// 対象外のパッケージは理由とともに Filtered に記録する
+	filtered := list.KBs()[0].Filtered
+	if len(filtered) != 1 || !strings.Contains(filtered[0].Package.Title, "x86-based") || filtered[0].Reason == "" {
+		t.Errorf("Filtered = %v, want x86 package with reason", filtered)
+	}
+}
+
+// TestNewKBListBuildFilter : BuildOptions.Filter に一致しないパッケージは対象外にする
+func TestNewKBListBuildFilter(t *testing.T) {
+	newTestCatalog(t)
+
+	filter, err := ParseFilter("arch=x86; title~Windows 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := NewKBList(context.Background(), []KBSpec{{No: 4103723}}, 2, BuildOptions{Filter: filter})
+	if err != nil {
+		t.Fatalf("NewKBList error = %v", err)
+	}
+	kb := list.KBs()[0]
+	if len(kb.PackageInfos) != 1 || !strings.Contains(kb.PackageInfos[0].Title, "x86-based") {
+		t.Errorf("packages = %v, want x86 package only", kb.PackageInfos)
+	}
+	if len(kb.Filtered) != 1 || kb.Filtered[0].Reason != "not matched filter [arch=x86]" {
+		t.Errorf("Filtered = %v, want x64 package not matched arch=x86", kb.Filtered)
+	}
+}
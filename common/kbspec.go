@@ -0,0 +1,362 @@
+package kb
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// KBSpec : 処理対象の KB 番号と、その KB のパッケージに対する絞り込み条件
+type KBSpec struct {
+	No           int
+	Product      string
+	Architecture string
+	Language     string
+}
+
+// HeaderMode : CSV のヘッダ行の扱い
+type HeaderMode int
+
+const (
+	// HeaderAuto : 1行目の KB 列が KB 番号として解釈できなければヘッダとみなす
+	HeaderAuto HeaderMode = iota
+	// HeaderPresent : 1行目は必ずヘッダ
+	HeaderPresent
+	// HeaderAbsent : ヘッダ行なし
+	HeaderAbsent
+)
+
+// CSVOption : KB 一覧 CSV の読み込みオプション
+type CSVOption struct {
+	// KBColumn : KB 番号の列。列名 または 1 始まりの列番号。空の場合は "KB" 列(ヘッダがなければ1列目)
+	KBColumn string
+	Header   HeaderMode
+}
+
+// CSVRowError : CSV の行単位のエラー
+type CSVRowError struct {
+	Line int
+	Err  error
+}
+
+func (e CSVRowError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// CSVError : CSV 読み込み時の不正な行の一覧
+type CSVError struct {
+	Rows []CSVRowError
+}
+
+func (e *CSVError) Error() string {
+	msgs := make([]string, 0, len(e.Rows))
+	for _, row := range e.Rows {
+		msgs = append(msgs, row.Error())
+	}
+	return fmt.Sprintf("%d malformed row(s) in CSV: %s", len(e.Rows), strings.Join(msgs, "; "))
+}
+
+// 絞り込み条件の列として認識する列名
+var (
+	kbColumnNames           = []string{"kb", "kbno", "kb no", "kbnumber", "kb number"}
+	productColumnNames      = []string{"product", "products"}
+	architectureColumnNames = []string{"arch", "architecture"}
+	languageColumnNames     = []string{"lang", "language"}
+)
+
+// ParseKBNo : "4103723" や "KB4103723" 形式の文字列を KB 番号に変換する
+func ParseKBNo(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && strings.EqualFold(s[:2], "kb") {
+		s = strings.TrimSpace(s[2:])
+	}
+	if s == "" {
+		return 0, errors.New("empty KB number")
+	}
+	no, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid KB number %q", s)
+	}
+	if no <= 0 {
+		return 0, fmt.Errorf("invalid KB number %q", s)
+	}
+	return no, nil
+}
+
+// ReadKBSpecsFromCSV : CSV から KB 番号と絞り込み条件を読み込む
+// 不正な行があっても読み込みは継続し、正常な行の一覧と *CSVError を返す
+func ReadKBSpecsFromCSV(r io.Reader, opt CSVOption) ([]KBSpec, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.LazyQuotes = true
+
+	var (
+		specs   []KBSpec
+		rowErrs []CSVRowError
+		columns = csvColumns{kb: -1, product: -1, architecture: -1, language: -1}
+		first   = true
+	)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				rowErrs = append(rowErrs, CSVRowError{Line: parseErr.StartLine, Err: parseErr.Err})
+				continue
+			}
+			return specs, err
+		}
+		line, _ := reader.FieldPos(0)
+
+		if first {
+			first = false
+			isHeader, err := columns.resolve(record, opt)
+			if err != nil {
+				return nil, CSVRowError{Line: line, Err: err}
+			}
+			if isHeader {
+				continue
+			}
+		}
+
+		spec, err := columns.spec(record)
+		if err != nil {
+			rowErrs = append(rowErrs, CSVRowError{Line: line, Err: err})
+			continue
+		}
+		specs = append(specs, spec)
+	}
+
+	if len(rowErrs) > 0 {
+		return specs, &CSVError{Rows: rowErrs}
+	}
+	return specs, nil
+}
+
+// csvColumns : CSV 内の各列の位置(存在しない場合は -1)
+type csvColumns struct {
+	kb           int
+	product      int
+	architecture int
+	language     int
+}
+
+// resolve : 1行目から各列の位置を決定する。1行目がヘッダかどうかを返す
+func (c *csvColumns) resolve(record []string, opt CSVOption) (bool, error) {
+	// 先頭の BOM は取り除く
+	if len(record) > 0 {
+		record[0] = strings.TrimPrefix(record[0], "\ufeff")
+	}
+
+	// KB 列の指定(列番号 または 列名)
+	index, name := -1, ""
+	if opt.KBColumn != "" {
+		if n, err := strconv.Atoi(opt.KBColumn); err == nil {
+			if n < 1 {
+				return false, fmt.Errorf("invalid KB column %q", opt.KBColumn)
+			}
+			index = n - 1
+		} else {
+			name = opt.KBColumn
+		}
+	}
+
+	isHeader := opt.Header == HeaderPresent
+	if opt.Header == HeaderAuto {
+		if name != "" {
+			isHeader = findColumn(record, []string{name}) >= 0
+		} else {
+			idx := index
+			if idx < 0 {
+				idx = findColumn(record, kbColumnNames)
+			}
+			if idx < 0 {
+				idx = 0
+			}
+			if idx < len(record) {
+				_, err := ParseKBNo(record[idx])
+				isHeader = err != nil
+			}
+		}
+	}
+
+	if !isHeader {
+		if name != "" {
+			return false, fmt.Errorf("KB column %q is specified by name, but CSV has no header", name)
+		}
+		c.kb = 0
+		if index >= 0 {
+			c.kb = index
+		}
+		return false, nil
+	}
+
+	switch {
+	case index >= 0:
+		c.kb = index
+	case name != "":
+		c.kb = findColumn(record, []string{name})
+		if c.kb < 0 {
+			return true, fmt.Errorf("KB column %q not found in header", name)
+		}
+	default:
+		c.kb = findColumn(record, kbColumnNames)
+		if c.kb < 0 {
+			c.kb = 0
+		}
+	}
+	c.product = findColumn(record, productColumnNames)
+	c.architecture = findColumn(record, architectureColumnNames)
+	c.language = findColumn(record, languageColumnNames)
+	return true, nil
+}
+
+// spec : 1行分のレコードを KBSpec に変換する
+func (c csvColumns) spec(record []string) (KBSpec, error) {
+	if c.kb >= len(record) {
+		return KBSpec{}, fmt.Errorf("missing KB column(column %d)", c.kb+1)
+	}
+	no, err := ParseKBNo(record[c.kb])
+	if err != nil {
+		return KBSpec{}, err
+	}
+	return KBSpec{
+		No:           no,
+		Product:      field(record, c.product),
+		Architecture: field(record, c.architecture),
+		Language:     field(record, c.language),
+	}, nil
+}
+
+func field(record []string, idx int) string {
+	if idx < 0 || idx >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[idx])
+}
+
+func findColumn(record []string, names []string) int {
+	for i, v := range record {
+		v = strings.TrimSpace(v)
+		for _, name := range names {
+			if strings.EqualFold(v, name) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// HasFilter : 絞り込み条件が指定されているかどうか
+func (spec KBSpec) HasFilter() bool {
+	return spec.Product != "" || spec.Architecture != "" || spec.Language != ""
+}
+
+// Match : パッケージが絞り込み条件に一致するかどうか
+func (spec KBSpec) Match(p *PackageInfo) bool {
+	if spec.Product != "" && !strings.Contains(strings.ToLower(p.Title), strings.ToLower(spec.Product)) {
+		return false
+	}
+	if spec.Architecture != "" && !matchArchitecture(p, spec.Architecture) {
+		return false
+	}
+	if spec.Language != "" && !matchLanguage(p, spec.Language) {
+		return false
+	}
+	return true
+}
+
+// architectureAliases : アーキテクチャ名の表記ゆれ
+var architectureAliases = map[string]string{
+	"x64":   "amd64",
+	"amd64": "amd64",
+	"x86":   "x86",
+	"arm64": "arm64",
+	"ia64":  "ia64",
+}
+
+func normalizeArchitecture(arch string) string {
+	arch = strings.ToLower(strings.TrimSpace(arch))
+	if v, ok := architectureAliases[arch]; ok {
+		return v
+	}
+	return arch
+}
+
+// matchArchitecture : いずれかのファイルのアーキテクチャが一致するかどうか
+func matchArchitecture(p *PackageInfo, arch string) bool {
+	want := normalizeArchitecture(arch)
+	for _, file := range p.Files {
+		if file.Architecture != "" && normalizeArchitecture(file.Architecture) == want {
+			return true
+		}
+	}
+	// カタログにアーキテクチャの記載がない場合はタイトルから判断
+	title := strings.ToLower(p.Title)
+	for alias, v := range architectureAliases {
+		if v == want && strings.Contains(title, alias+"-based") {
+			return true
+		}
+	}
+	return false
+}
+
+// matchLanguage : いずれかのファイルの言語が一致するかどうか
+// 言語指定のないファイルは全言語共通とみなす
+func matchLanguage(p *PackageInfo, lang string) bool {
+	for _, file := range p.Files {
+		if file.Language == "" || strings.EqualFold(file.Language, lang) {
+			return true
+		}
+	}
+	return false
+}
+
+// MergeKBSpecs : 複数の KBSpec の一覧を結合し、重複を取り除く(順序は最初に現れた順)
+func MergeKBSpecs(lists ...[]KBSpec) []KBSpec {
+	seen := map[KBSpec]bool{}
+	merged := []KBSpec{}
+	for _, list := range lists {
+		for _, spec := range list {
+			if seen[spec] {
+				continue
+			}
+			seen[spec] = true
+			merged = append(merged, spec)
+		}
+	}
+	return merged
+}
+
+// groupKBSpecs : KB 番号単位で絞り込み条件をまとめる(順序は最初に現れた順)
+func groupKBSpecs(specs []KBSpec) ([]int, map[int][]KBSpec) {
+	nos := []int{}
+	groups := map[int][]KBSpec{}
+	for _, spec := range specs {
+		if _, ok := groups[spec.No]; !ok {
+			nos = append(nos, spec.No)
+		}
+		groups[spec.No] = append(groups[spec.No], spec)
+	}
+	return nos, groups
+}
+
+// matchKBSpecs : いずれかの条件に一致するかどうかを判定する関数。条件なしの指定があれば全て一致とする
+func matchKBSpecs(specs []KBSpec) func(p *PackageInfo) (bool, string) {
+	return func(p *PackageInfo) (bool, string) {
+		for _, spec := range specs {
+			if !spec.HasFilter() || spec.Match(p) {
+				return true, ""
+			}
+		}
+		return false, "not matched product/architecture/language of KB list"
+	}
+}
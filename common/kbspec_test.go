@@ -0,0 +1,154 @@
+package kb
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestParseKBNo : KB 番号の表記(KB 接頭辞、空白、大文字小文字)
+func TestParseKBNo(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{in: "4103723", want: 4103723},
+		{in: "KB4103723", want: 4103723},
+		{in: "kb4103723", want: 4103723},
+		{in: " KB 4103723 ", want: 4103723},
+		{in: "", wantErr: true},
+		{in: "KB", wantErr: true},
+		{in: "KB-4103723", wantErr: true},
+		{in: "abc", wantErr: true},
+		{in: "0", wantErr: true},
+		{in: "-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseKBNo(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseKBNo(%q) error = %v, wantErr %t", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseKBNo(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+// TestReadKBSpecsFromCSV : ヘッダの判定、KB 列の指定、コメント行、絞り込み条件の列
+func TestReadKBSpecsFromCSV(t *testing.T) {
+	tests := []struct {
+		name string
+		csv  string
+		opt  CSVOption
+		want []KBSpec
+	}{
+		{
+			name: "no header",
+			csv:  "4103723\nKB4093105\n",
+			want: []KBSpec{{No: 4103723}, {No: 4093105}},
+		},
+		{
+			name: "header detected with filter columns",
+			csv:  "Product,KB,Arch,Language\nWindows 10,KB4103723,x64,ja-jp\nWindows Server 2016,4093105,,\n",
+			want: []KBSpec{
+				{No: 4103723, Product: "Windows 10", Architecture: "x64", Language: "ja-jp"},
+				{No: 4093105, Product: "Windows Server 2016"},
+			},
+		},
+		{
+			name: "BOM and comment lines",
+			csv:  "\ufeffkb,arch\n# 2018-05\n4103723,x86\n",
+			want: []KBSpec{{No: 4103723, Architecture: "x86"}},
+		},
+		{
+			name: "column by name",
+			csv:  "title,update\nfoo,4103723\n",
+			opt:  CSVOption{KBColumn: "update"},
+			want: []KBSpec{{No: 4103723}},
+		},
+		{
+			name: "column by number without header",
+			csv:  "foo,4103723\nbar,4093105\n",
+			opt:  CSVOption{KBColumn: "2", Header: HeaderAbsent},
+			want: []KBSpec{{No: 4103723}, {No: 4093105}},
+		},
+		{
+			name: "header forced",
+			csv:  "4000000\n4103723\n",
+			opt:  CSVOption{Header: HeaderPresent},
+			want: []KBSpec{{No: 4103723}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadKBSpecsFromCSV(strings.NewReader(tt.csv), tt.opt)
+			if err != nil {
+				t.Fatalf("ReadKBSpecsFromCSV error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadKBSpecsFromCSV = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestReadKBSpecsFromCSVRowErrors : 不正な行は行番号とともに *CSVError で返し、正常な行は読み込む
+func TestReadKBSpecsFromCSVRowErrors(t *testing.T) {
+	csv := "kb,arch\n4103723,x64\nabc,x86\n\n,x64\n4093105\n"
+	got, err := ReadKBSpecsFromCSV(strings.NewReader(csv), CSVOption{})
+	var csvErr *CSVError
+	if !errors.As(err, &csvErr) {
+		t.Fatalf("ReadKBSpecsFromCSV error = %v, want *CSVError", err)
+	}
+	want := []KBSpec{{No: 4103723, Architecture: "x64"}, {No: 4093105}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadKBSpecsFromCSV = %+v, want %+v", got, want)
+	}
+	lines := []int{}
+	for _, row := range csvErr.Rows {
+		lines = append(lines, row.Line)
+	}
+	if !reflect.DeepEqual(lines, []int{3, 5}) {
+		t.Errorf("malformed lines = %v, want [3 5]", lines)
+	}
+}
+
+// TestReadKBSpecsFromCSVInvalidOption : KB 列の指定の誤りは行単位のエラーではなく、読み込み自体のエラー
+func TestReadKBSpecsFromCSVInvalidOption(t *testing.T) {
+	tests := []struct {
+		name string
+		csv  string
+		opt  CSVOption
+	}{
+		{name: "column not in header", csv: "kb,arch\n4103723,x64\n", opt: CSVOption{KBColumn: "update", Header: HeaderPresent}},
+		{name: "column by name without header", csv: "4103723\n", opt: CSVOption{KBColumn: "kb", Header: HeaderAbsent}},
+		{name: "column number zero", csv: "4103723\n", opt: CSVOption{KBColumn: "0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			specs, err := ReadKBSpecsFromCSV(strings.NewReader(tt.csv), tt.opt)
+			var csvErr *CSVError
+			if err == nil || errors.As(err, &csvErr) {
+				t.Errorf("ReadKBSpecsFromCSV error = %v, want option error", err)
+			}
+			if len(specs) != 0 {
+				t.Errorf("ReadKBSpecsFromCSV = %+v, want none", specs)
+			}
+		})
+	}
+}
+
+// TestMergeKBSpecs : 重複を取り除き、最初に現れた順序を保つ
+func TestMergeKBSpecs(t *testing.T) {
+	got := MergeKBSpecs(
+		[]KBSpec{{No: 4103723}, {No: 4093105}},
+		[]KBSpec{{No: 4103723}, {No: 4103723, Architecture: "x64"}},
+	)
+	want := []KBSpec{{No: 4103723}, {No: 4093105}, {No: 4103723, Architecture: "x64"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MergeKBSpecs = %+v, want %+v", got, want)
+	}
+}
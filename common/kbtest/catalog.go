@@ -0,0 +1,253 @@
+// Package kbtest : Windows Update カタログの偽サーバ。オフライン環境で kb パッケージを検証するために使用する
+package kbtest
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+//go:embed fixtures/*.html
+var fixtures embed.FS
+
+// Payloads : 偽サーバが配信するファイル名とサイズ(バイト)
+var Payloads = map[string]int{
+	"windows10.0-kb4103723-x64_2adf2780c6f8c1ebb9f8b2e0c0e1a5f0e2b3a4c5.msu": 65536,
+	"windows10.0-kb4103723-x86_8b1d0c9e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b2c.msu": 40960,
+	"windows10.0-kb4103723-x86_8b1d0c9e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b2c.psf": 8192,
+	"windows10.0-kb4093105-x64_5f3e2d1c0b9a8f7e6d5c4b3a2f1e0d9c8b7a6f5e.msu": 32768,
+	"windows10.0-kb4103727-x64_c217e7d5e2efdf9ff8446871e509e96fdbb8cb99.msu": 36864,
+	"windows10.0-kb4284819-x64_6d6c5e1c3c5e3a9b3e6d5c4b3a2f1e0d9c8b7a6f.msu": 40960,
+	"windows10.0-kb4284819-x86_3c8e1f2a4b6d8e0f1a3c5e7f9b1d3f5a7c9e1b3d.msu": 36864,
+}
+
+// CatalogServer : 記録済みの Search.aspx / DownloadDialog.aspx / ScopedViewInline.aspx のフィクスチャを返すカタログの偽サーバ
+// ダウンロードリンクは偽サーバ自身を指し、Range リクエストにも対応する
+// サポート技術情報の KB の記事(/en-us/help/<KB 番号>)も返すため、kb.NewArticleClient の URL にも指定できる
+type CatalogServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	failures map[string][]int
+	requests map[string]int
+}
+
+// NewCatalogServer : 偽サーバを起動する。使用後は Close を呼び出すこと
+func NewCatalogServer() *CatalogServer {
+	s := &CatalogServer{
+		failures: map[string][]int{},
+		requests: map[string]int{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Search.aspx", s.handleSearch)
+	mux.HandleFunc("/DownloadDialog.aspx", s.handleDownloadDialog)
+	mux.HandleFunc("/ScopedViewInline.aspx", s.handleDetails)
+	mux.HandleFunc("/en-us/help/", s.handleArticleRedirect)
+	mux.HandleFunc("/en-us/topic/", s.handleArticle)
+	mux.HandleFunc("/c/", s.handleFile)
+	mux.HandleFunc("/d/", s.handleFile)
+	s.Server = httptest.NewServer(s.intercept(mux))
+	return s
+}
+
+// FailNext : path への次回以降のリクエストに、指定したステータスコードを順に返す
+// 429 と 503 の場合は Retry-After: 1 を付与する
+func (s *CatalogServer) FailNext(path string, statuses ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[path] = append(s.failures[path], statuses...)
+}
+
+// Requests : path へのリクエスト回数
+func (s *CatalogServer) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// Payload : 偽サーバが配信するファイルの内容
+func Payload(fileName string) []byte {
+	size, ok := Payloads[fileName]
+	if !ok {
+		return nil
+	}
+	seed := []byte(fileName + "\n")
+	return bytes.Repeat(seed, size/len(seed)+1)[:size]
+}
+
+func (s *CatalogServer) intercept(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests[r.URL.Path]++
+		status := 0
+		if queue := s.failures[r.URL.Path]; len(queue) > 0 {
+			status = queue[0]
+			s.failures[r.URL.Path] = queue[1:]
+		}
+		s.mu.Unlock()
+
+		if status != 0 {
+			if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+				w.Header().Set("Retry-After", "1")
+			}
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleSearch : 検索結果。1ページ目は search_<検索語>.html、2ページ目以降は search_<検索語>_p<ページ>.html
+// 2ページ目以降は、実際のカタログと同様に __VIEWSTATE と __EVENTTARGET のポストバックで取得する
+func (s *CatalogServer) handleSearch(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	page := 1
+	if r.Method == "POST" {
+		current, err := strconv.Atoi(strings.TrimPrefix(decodeViewState(r.PostFormValue("__VIEWSTATE")), "page:"))
+		if err != nil {
+			http.Error(w, "invalid __VIEWSTATE", http.StatusBadRequest)
+			return
+		}
+		switch r.PostFormValue("__EVENTTARGET") {
+		case "ctl00$catalogBody$nextPageLinkText":
+			page = current + 1
+		case "ctl00$catalogBody$prevPageLinkText":
+			page = current - 1
+		default:
+			page = current
+		}
+	}
+	name := "fixtures/search_" + fixtureKey(query) + ".html"
+	if page > 1 {
+		name = fmt.Sprintf("fixtures/search_%s_p%d.html", fixtureKey(query), page)
+	}
+	if _, err := fixtures.Open(name); err != nil {
+		if page > 1 {
+			http.Error(w, "page not found", http.StatusBadRequest)
+			return
+		}
+		name = "fixtures/search_noresult.html"
+	}
+	s.render(w, name, map[string]string{
+		"Query":     query,
+		"ViewState": base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("page:%d", page))),
+	})
+}
+
+// decodeViewState : 偽サーバの __VIEWSTATE(ページ番号)
+func decodeViewState(v string) string {
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+func (s *CatalogServer) handleDownloadDialog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var ids []struct {
+		UpdateID string `json:"updateID"`
+	}
+	if err := json.Unmarshal([]byte(r.PostFormValue("updateIDs")), &ids); err != nil || len(ids) == 0 {
+		http.Error(w, "invalid updateIDs", http.StatusBadRequest)
+		return
+	}
+	name := "fixtures/dialog_" + fixtureKey(ids[0].UpdateID) + ".html"
+	if _, err := fixtures.Open(name); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	s.render(w, name, nil)
+}
+
+// handleDetails : 詳細ページ。実際のカタログと同様、存在しない updateid の場合もエラーページを 200 で返す
+func (s *CatalogServer) handleDetails(w http.ResponseWriter, r *http.Request) {
+	name := "fixtures/details_" + fixtureKey(r.URL.Query().Get("updateid")) + ".html"
+	if _, err := fixtures.Open(name); err != nil {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, `<html><body><div id="errorPageDisplayedError">The website has encountered a problem</div></body></html>`)
+		return
+	}
+	s.render(w, name, nil)
+}
+
+// handleArticleRedirect : KB の記事。実際のサポートサイトと同様、記事のページ(/en-us/topic/)にリダイレクトする
+// フィクスチャ(article_<KB 番号>.html)がない KB は 404 を返す
+func (s *CatalogServer) handleArticleRedirect(w http.ResponseWriter, r *http.Request) {
+	key := fixtureKey(path.Base(r.URL.Path))
+	if _, err := fixtures.Open("fixtures/article_" + key + ".html"); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, "/en-us/topic/kb"+key, http.StatusMovedPermanently)
+}
+
+func (s *CatalogServer) handleArticle(w http.ResponseWriter, r *http.Request) {
+	name := "fixtures/article_" + fixtureKey(path.Base(r.URL.Path)) + ".html"
+	if _, err := fixtures.Open(name); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	s.render(w, name, nil)
+}
+
+func (s *CatalogServer) handleFile(w http.ResponseWriter, r *http.Request) {
+	body := Payload(path.Base(r.URL.Path))
+	if body == nil {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, path.Base(r.URL.Path), time.Date(2018, 5, 8, 0, 0, 0, 0, time.UTC), bytes.NewReader(body))
+}
+
+// render : フィクスチャのテンプレートに偽サーバの URL とダイジェストを埋め込んで返す
+func (s *CatalogServer) render(w http.ResponseWriter, name string, extra map[string]string) {
+	tmpl, err := template.New(path.Base(name)).Funcs(template.FuncMap{
+		"sha1": func(fileName string) string {
+			sum := sha1.Sum(Payload(fileName))
+			return base64.StdEncoding.EncodeToString(sum[:])
+		},
+		"sha256": func(fileName string) string {
+			sum := sha256.Sum256(Payload(fileName))
+			return base64.StdEncoding.EncodeToString(sum[:])
+		},
+	}).ParseFS(fixtures, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := map[string]string{"BaseURL": s.URL}
+	for k, v := range extra {
+		data[k] = v
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, fmt.Sprintf("render %s: %v", name, err), http.StatusInternalServerError)
+	}
+}
+
+// fixtureKey : 検索語や更新 ID をフィクスチャのファイル名に変換する
+func fixtureKey(s string) string {
+	s = strings.ToLower(strings.TrimPrefix(strings.ToLower(s), "kb"))
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+}
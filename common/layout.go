@@ -0,0 +1,141 @@
+package kb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultLayout : 既定の配置(出力先ディレクトリの直下にファイル名で保存する)
+const DefaultLayout = "{filename}"
+
+// layoutFields : 配置のテンプレートで使用できる項目
+var layoutFields = map[string]func(kb *KB, pkg *PackageInfo, file *PackageFile) string{
+	"kb":             func(kb *KB, pkg *PackageInfo, file *PackageFile) string { return strconv.Itoa(kb.no) },
+	"arch":           func(kb *KB, pkg *PackageInfo, file *PackageFile) string { return file.Architecture },
+	"lang":           func(kb *KB, pkg *PackageInfo, file *PackageFile) string { return file.Language },
+	"product":        func(kb *KB, pkg *PackageInfo, file *PackageFile) string { return pkg.Products },
+	"classification": func(kb *KB, pkg *PackageInfo, file *PackageFile) string { return pkg.Classification },
+	"updateid":       func(kb *KB, pkg *PackageInfo, file *PackageFile) string { return pkg.UpdateID },
+	"filename":       func(kb *KB, pkg *PackageInfo, file *PackageFile) string { return file.FileName },
+}
+
+// layoutFieldRegexp : テンプレート中の項目({kb} など)
+var layoutFieldRegexp = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// Layout : ダウンロードしたファイルの配置。出力先ディレクトリからの相対パスのテンプレート
+// 例) {kb}/{arch}/{filename}, {product}/{kb}/{filename}
+type Layout struct {
+	template string
+}
+
+// ParseLayout : 配置のテンプレートを解析する。空の場合は DefaultLayout
+// {filename} が必須。絶対パス、.. を含むテンプレートはエラー
+func ParseLayout(template string) (*Layout, error) {
+	template = strings.TrimSpace(template)
+	if template == "" {
+		template = DefaultLayout
+	}
+	for _, m := range layoutFieldRegexp.FindAllStringSubmatch(template, -1) {
+		if _, ok := layoutFields[strings.ToLower(m[1])]; !ok {
+			return nil, fmt.Errorf("unknown layout field: {%s}(kb, arch, lang, product, classification, updateid, filename)", m[1])
+		}
+	}
+	if !strings.Contains(strings.ToLower(template), "{filename}") {
+		return nil, fmt.Errorf("layout must contain {filename}: %s", template)
+	}
+	if strings.HasPrefix(template, "/") || strings.HasPrefix(template, `\`) || filepath.VolumeName(template) != "" {
+		return nil, fmt.Errorf("layout must be relative path: %s", template)
+	}
+	for _, segment := range splitLayout(template) {
+		if segment == ".." {
+			return nil, fmt.Errorf("layout must not contain '..': %s", template)
+		}
+	}
+	return &Layout{template: template}, nil
+}
+
+// String : テンプレート
+func (l *Layout) String() string {
+	if l == nil {
+		return DefaultLayout
+	}
+	return l.template
+}
+
+// Path : ファイルの出力先ディレクトリからの相対パス
+// 各項目の値はパスの1要素としてサニタイズするため、カタログの値にパス区切りや .. が含まれても出力先ディレクトリの外には出ない
+func (l *Layout) Path(kb *KB, pkg *PackageInfo, file *PackageFile) (string, error) {
+	segments := []string{}
+	for _, segment := range splitLayout(l.String()) {
+		if segment == "" || segment == "." {
+			continue
+		}
+		v := layoutFieldRegexp.ReplaceAllStringFunc(segment, func(field string) string {
+			return layoutFields[strings.ToLower(strings.Trim(field, "{}"))](kb, pkg, file)
+		})
+		segments = append(segments, SanitizeFileName(v))
+	}
+	path := filepath.Join(segments...)
+	if !filepath.IsLocal(path) {
+		return "", fmt.Errorf("invalid file path: layout=[%s], path=[%s]", l.String(), path)
+	}
+	return path, nil
+}
+
+// splitLayout : テンプレートをパスの要素に分割する(/ と \ のどちらも区切りとする)
+func splitLayout(template string) []string {
+	return strings.FieldsFunc(template, func(r rune) bool { return r == '/' || r == '\\' })
+}
+
+// reservedFileNames : Windows の予約済みのファイル名
+var reservedFileNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeFileName : カタログのファイル名などをパスの1要素として安全な名前にする
+// パス区切り、Windows で使用できない文字、制御文字は _ に置き換え、末尾の空白と . は除く
+// 空、. と .. は _ にし、予約済みの名前(CON など)は先頭に _ を付ける
+func SanitizeFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimRight(strings.TrimSpace(name), ". ")
+	if name == "" {
+		return "_"
+	}
+	base := strings.ToUpper(strings.SplitN(name, ".", 2)[0])
+	if reservedFileNames[base] {
+		name = "_" + name
+	}
+	return name
+}
+
+// ensureDir : 出力先ディレクトリ(root)の下にディレクトリを作成する
+// シンボリックリンクを辿った結果が root の外になる場合はエラー
+func ensureDir(root string, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(realRoot, realDir)
+	if err != nil || !filepath.IsLocal(rel) {
+		return fmt.Errorf("directory is outside of output directory: dir=[%s], root=[%s]", dir, root)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package kb
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestParseLayout : 項目名、{filename} の有無、絶対パスと .. の禁止
+func TestParseLayout(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+		wantErr  bool
+	}{
+		{template: "", want: DefaultLayout},
+		{template: " {kb}/{arch}/{filename} ", want: "{kb}/{arch}/{filename}"},
+		{template: `{Product}\{KB}\{FileName}`, want: `{Product}\{KB}\{FileName}`},
+		{template: "{kb}/{size}/{filename}", wantErr: true},
+		{template: "{kb}/{arch}", wantErr: true},
+		{template: "/tmp/{filename}", wantErr: true},
+		{template: `\share\{filename}`, wantErr: true},
+		{template: "{kb}/../{filename}", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseLayout(tt.template)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseLayout(%q) error = %v, wantErr %t", tt.template, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("ParseLayout(%q) = %s, want %s", tt.template, got, tt.want)
+		}
+	}
+	var layout *Layout
+	if layout.String() != DefaultLayout {
+		t.Errorf("nil Layout String() = %s, want %s", layout.String(), DefaultLayout)
+	}
+}
+
+// TestLayoutPath : 項目の値はパスの1要素としてサニタイズする
+func TestLayoutPath(t *testing.T) {
+	kb := &KB{no: 4103723}
+	pkg := &PackageInfo{UpdateID: "6b4b8a8f-0a5a-4a8b-9a1b-3f1d3c2e4a01", Products: "Windows 10/Server", Classification: "Security Updates"}
+	file := &PackageFile{FileName: "windows10.0-kb4103723-x64.msu", Architecture: "AMD64"}
+
+	tests := []struct {
+		template string
+		file     *PackageFile
+		want     string
+	}{
+		{template: "{filename}", file: file, want: "windows10.0-kb4103723-x64.msu"},
+		{template: "{kb}/{arch}/{filename}", file: file, want: filepath.Join("4103723", "AMD64", "windows10.0-kb4103723-x64.msu")},
+		{template: "{product}/KB{kb}_{lang}/./{filename}", file: file, want: filepath.Join("Windows 10_Server", "KB4103723_", "windows10.0-kb4103723-x64.msu")},
+		{template: "{classification}/{updateid}/{filename}", file: file, want: filepath.Join("Security Updates", pkg.UpdateID, "windows10.0-kb4103723-x64.msu")},
+		// カタログのファイル名にパス区切りや .. が含まれても出力先ディレクトリの外には出ない
+		{template: "{lang}/{filename}", file: &PackageFile{FileName: "../../evil.msu", Language: ".."}, want: filepath.Join("_", ".._.._evil.msu")},
+	}
+	for _, tt := range tests {
+		layout, err := ParseLayout(tt.template)
+		if err != nil {
+			t.Fatalf("ParseLayout(%q) error = %v", tt.template, err)
+		}
+		got, err := layout.Path(kb, pkg, tt.file)
+		if err != nil || got != tt.want {
+			t.Errorf("Path(%q) = (%s, %v), want %s", tt.template, got, err, tt.want)
+		}
+	}
+}
+
+// TestSanitizeFileName : パス区切り、使用できない文字、末尾の . と空白、予約済みの名前
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{in: "windows10.0-kb4103723-x64.msu", want: "windows10.0-kb4103723-x64.msu"},
+		{in: `a/b\c:d*e?f"g<h>i|j`, want: "a_b_c_d_e_f_g_h_i_j"},
+		{in: "tab\tname\x7f", want: "tab_name_"},
+		{in: " name. . ", want: "name"},
+		{in: "", want: "_"},
+		{in: ".", want: "_"},
+		{in: "..", want: "_"},
+		{in: "CON", want: "_CON"},
+		{in: "nul.txt", want: "_nul.txt"},
+		{in: "COM10", want: "COM10"},
+	}
+	for _, tt := range tests {
+		if got := SanitizeFileName(tt.in); got != tt.want {
+			t.Errorf("SanitizeFileName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
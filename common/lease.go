@@ -0,0 +1,121 @@
+package kb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// ErrLeaseLost : セッションのリースが期限切れなどで他のワーカーに取得された
+var ErrLeaseLost = errors.New("session lease lost")
+
+// DefaultWorkerID : ワーカーの識別子の既定値(ホスト名とプロセス ID)
+func DefaultWorkerID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// Claim : 登録済みのセッションを workerID のワーカーが処理するために取得する
+// 条件付きの UPDATE で状態とワーカー、リースの期限を同時に変更するため、複数のデーモンが同じセッションを取得することはない
+// リースの期限はデータベースの時刻で計算する(ホスト間の時刻のずれの影響を受けない)
+// 他のワーカーが先に取得した場合は false を返す
+func (session *Session) Claim(workerID string, lease time.Duration) (bool, error) {
+	claimed, err := session.claim(workerID, lease, StatusMetadataInprogress, "attempt_count = attempt_count + 1, ",
+		"status = ? AND (lease_expires_utc IS NULL OR lease_expires_utc < UTC_TIMESTAMP())", StatusRegistered)
+	if claimed {
+		session.Attempts++
+	}
+	return claimed, err
+}
+
+// ClaimStale : 処理中のまま中断した(リースが期限切れの)セッションを、再開するために取得する。状態は変更しない
+// リースのないセッションは、最終更新日時から lease 以上経過している場合に中断したとみなす
+func (session *Session) ClaimStale(workerID string, lease time.Duration) (bool, error) {
+	return session.claim(workerID, lease, session.Status, "", "status = ? AND "+StaleCondition, session.Status, time.Now().Add(-lease))
+}
+
+// ClaimInterrupted : デーモンの停止で中断したセッションを、再開するために取得する。リースの期限を待たずに取得できる
+// 状態は中断した段階の状態に戻す
+func (session *Session) ClaimInterrupted(workerID string, lease time.Duration) (bool, error) {
+	return session.claim(workerID, lease, session.Status&^StatusInterrupted, "",
+		"status = ? AND (lease_expires_utc IS NULL OR lease_expires_utc < UTC_TIMESTAMP())", session.Status)
+}
+
+// claim : condition を満たす場合にセッションを取得し、状態を toStatus に変更する。set は同時に変更する列(末尾に ", " を付ける)
+func (session *Session) claim(workerID string, lease time.Duration, toStatus int, set string, condition string, args ...interface{}) (bool, error) {
+	args = append([]interface{}{toStatus, workerID, int(lease.Seconds()), time.Now(), session.ID, session.Kbno}, args...)
+	result, err := session.Db.Exec(
+		"UPDATE session SET "+set+"status = ?, worker_id = ?, lease_expires_utc = DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? SECOND), update_utc_date = ? "+
+			"WHERE id = ? AND kbno = ? AND "+condition,
+		args...,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, nil
+	}
+	log.Printf("Claim session: id=[%s], kbno=[%d], status=[%d], worker=[%s], lease=[%s]", session.ID.String, session.Kbno, toStatus, workerID, lease)
+	session.WorkerID = workerID
+	session.Status = toStatus
+	return true, nil
+}
+
+// extendLease : リースの期限を延長する。他のワーカーに取得されていた場合は ErrLeaseLost
+func (session *Session) extendLease(lease time.Duration) error {
+	result, err := session.Db.Exec(
+		"UPDATE session SET lease_expires_utc = DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? SECOND) WHERE id = ? AND kbno = ? AND worker_id = ?",
+		int(lease.Seconds()), session.ID, session.Kbno, session.WorkerID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("%w: id=[%s], kbno=[%d], worker=[%s]", ErrLeaseLost, session.ID.String, session.Kbno, session.WorkerID)
+	}
+	return nil
+}
+
+// Heartbeat : 処理中のセッションのリースを lease/3 ごとに延長する。ctx が終了するまで続ける
+// リースを失った場合は cancel(ErrLeaseLost) を呼び出して処理を中断させる。延長に失敗(データベースのエラー)した場合は次の間隔で再度延長する
+func (session *Session) Heartbeat(ctx context.Context, lease time.Duration, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := session.extendLease(lease)
+			if errors.Is(err, ErrLeaseLost) {
+				log.Printf("Lease lost. cancel session.. : id=[%s], kbno=[%d], error=[%v]", session.ID.String, session.Kbno, err)
+				cancel(err)
+				return
+			}
+			if err != nil {
+				log.Printf("Extend lease error: id=[%s], kbno=[%d], error=[%v]", session.ID.String, session.Kbno, err)
+			}
+		}
+	}
+}
+
+// Release : リースを解放する。ワーカーの識別子は処理したワーカーとして残す
+func (session *Session) Release() {
+	_, err := session.Db.Exec(
+		"UPDATE session SET lease_expires_utc = NULL WHERE id = ? AND kbno = ? AND worker_id = ?",
+		session.ID, session.Kbno, session.WorkerID,
+	)
+	if err != nil {
+		log.Printf("Release lease error: id=[%s], kbno=[%d], error=[%v]", session.ID.String, session.Kbno, err)
+	}
+}
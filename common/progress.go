@@ -0,0 +1,345 @@
+package kb
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProgressReader : 読み込んだバイト数を report に通知する io.Reader
+type ProgressReader struct {
+	r      io.Reader
+	report func(n int64)
+}
+
+// NewProgressReader : r から読み込むたびに読み込んだバイト数を report に通知する ProgressReader を生成する
+func NewProgressReader(r io.Reader, report func(n int64)) *ProgressReader {
+	return &ProgressReader{r: r, report: report}
+}
+
+// Read : io.Reader
+func (r *ProgressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 && r.report != nil {
+		r.report(int64(n))
+	}
+	return n, err
+}
+
+// Progress : 複数のファイルの転送(ダウンロード、アップロード)の進捗の集計
+// nil の場合は何も集計しない
+type Progress struct {
+	mu        sync.Mutex
+	startedAt time.Time
+	files     int
+	total     int64
+	completed int
+	// transferred : 転送済みのバイト数(再開した場合の既存の部分を含む)
+	transferred int64
+	// read : この実行で転送したバイト数(スループットの計算に使用する)
+	read      int64
+	transfers []*Transfer
+}
+
+// Transfer : ファイルごとの転送の進捗
+type Transfer struct {
+	progress *Progress
+	Package  *PackageInfo
+	File     *PackageFile
+	// 以下は progress.mu で保護する
+	transferred int64
+	done        bool
+	changed     bool
+}
+
+// ProgressSnapshot : ある時点の全体の進捗
+type ProgressSnapshot struct {
+	// Files, Completed : 対象のファイル数と完了(失敗・スキップを含む)したファイル数
+	Files     int
+	Completed int
+	// Active : 転送中のファイル数
+	Active int
+	// Total : 対象のファイルの合計サイズ(サイズが不明なファイルは含まない)
+	Total       int64
+	Transferred int64
+	// Read : この実行で転送したバイト数
+	Read    int64
+	Elapsed time.Duration
+}
+
+// NewProgress : 進捗の集計を生成する
+func NewProgress() *Progress {
+	return &Progress{startedAt: time.Now()}
+}
+
+// Plan : 転送の対象のファイルを追加する。全体の割合の計算に使用する
+func (p *Progress) Plan(file *PackageFile) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.files++
+	if file.FileSize > 0 {
+		p.total += file.FileSize
+	}
+}
+
+// Start : ファイルの転送を開始する。p が nil の場合は nil(Transfer のメソッドは何もしない)
+func (p *Progress) Start(pkg *PackageInfo, file *PackageFile) *Transfer {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t := &Transfer{progress: p, Package: pkg, File: file, changed: true}
+	p.transfers = append(p.transfers, t)
+	return t
+}
+
+// Set : 転送済みのバイト数を設定する(再開時の既存の部分、再試行時の 0 など)
+func (t *Transfer) Set(n int64) {
+	if t == nil {
+		return
+	}
+	if n < 0 {
+		// サイズが不明(-1)なファイル
+		n = 0
+	}
+	p := t.progress
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.transferred += n - t.transferred
+	t.transferred = n
+	t.changed = true
+}
+
+// Add : 転送したバイト数を加算する
+func (t *Transfer) Add(n int64) {
+	if t == nil {
+		return
+	}
+	p := t.progress
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.transferred += n
+	p.read += n
+	t.transferred += n
+	t.changed = true
+}
+
+// Done : 転送を終了する(成功・失敗のどちらも)
+func (t *Transfer) Done() {
+	if t == nil {
+		return
+	}
+	p := t.progress
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !t.done {
+		t.done = true
+		t.changed = true
+		p.completed++
+	}
+}
+
+// Transferred : ファイルの転送済みのバイト数
+func (t *Transfer) Transferred() int64 {
+	if t == nil {
+		return 0
+	}
+	t.progress.mu.Lock()
+	defer t.progress.mu.Unlock()
+	return t.transferred
+}
+
+// Snapshot : 現在の全体の進捗
+func (p *Progress) Snapshot() ProgressSnapshot {
+	if p == nil {
+		return ProgressSnapshot{}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := ProgressSnapshot{
+		Files:       p.files,
+		Completed:   p.completed,
+		Total:       p.total,
+		Transferred: p.transferred,
+		Read:        p.read,
+		Elapsed:     time.Since(p.startedAt),
+	}
+	for _, t := range p.transfers {
+		if !t.done {
+			s.Active++
+		}
+	}
+	return s
+}
+
+// Changed : 前回の呼び出しから進捗が変わったファイルの転送と転送済みのバイト数
+// 完了したファイルは最後の1回だけ返し、以降は集計の対象から外す
+func (p *Progress) Changed() map[*Transfer]int64 {
+	changed := map[*Transfer]int64{}
+	if p == nil {
+		return changed
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	active := p.transfers[:0]
+	for _, t := range p.transfers {
+		if t.changed {
+			changed[t] = t.transferred
+			t.changed = false
+		}
+		if !t.done {
+			active = append(active, t)
+		}
+	}
+	p.transfers = active
+	return changed
+}
+
+// Percent : 全体の割合(%)。合計サイズが不明な場合は -1
+func (s ProgressSnapshot) Percent() float64 {
+	if s.Total <= 0 {
+		return -1
+	}
+	percent := float64(s.Transferred) * 100 / float64(s.Total)
+	if percent > 100 {
+		percent = 100
+	}
+	return percent
+}
+
+// Throughput : この実行の平均スループット(バイト/秒)
+func (s ProgressSnapshot) Throughput() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Read) / s.Elapsed.Seconds()
+}
+
+// String : 進捗の1行の表示(ファイル数、バイト数、割合、スループット)
+func (s ProgressSnapshot) String() string {
+	return s.format(s.Throughput())
+}
+
+func (s ProgressSnapshot) format(rate float64) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%d/%d files, %s", s.Completed, s.Files, FormatBytes(s.Transferred))
+	if percent := s.Percent(); percent >= 0 {
+		fmt.Fprintf(b, " / %s (%.1f%%)", FormatBytes(s.Total), percent)
+	}
+	fmt.Fprintf(b, ", %s/s", FormatBytes(int64(rate)))
+	if s.Active > 0 {
+		fmt.Fprintf(b, ", %d active", s.Active)
+	}
+	return b.String()
+}
+
+// FormatBytes : バイト数の表示(1.5 GiB など)
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// ProgressDisplay : 全体の進捗を端末の1行に表示し続ける
+// ログは Write で出力すると、進捗の行を消してから出力し、進捗の行を再表示する
+type ProgressDisplay struct {
+	progress *Progress
+	w        io.Writer
+	label    string
+
+	mu   sync.Mutex
+	line string
+	// スループットは直近の間隔の転送量から計算する
+	lastRead int64
+	lastAt   time.Time
+	rate     float64
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewProgressDisplay : progress を w(端末)に表示する ProgressDisplay を生成する
+func NewProgressDisplay(progress *Progress, w io.Writer, label string) *ProgressDisplay {
+	return &ProgressDisplay{progress: progress, w: w, label: label, lastAt: time.Now(), stop: make(chan struct{})}
+}
+
+// Start : interval ごとに進捗の表示を更新する
+func (d *ProgressDisplay) Start(interval time.Duration) {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.render()
+			case <-d.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop : 表示の更新を止め、最終の進捗(平均スループット)を表示して改行する
+func (d *ProgressDisplay) Stop() {
+	close(d.stop)
+	d.wg.Wait()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.clear()
+	fmt.Fprintf(d.w, "%s: %s\n", d.label, d.progress.Snapshot())
+	d.line = ""
+}
+
+// Write : 進捗の行を消してから b を出力し、進捗の行を再表示する
+func (d *ProgressDisplay) Write(b []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.clear()
+	n, err := d.w.Write(b)
+	if d.line != "" {
+		fmt.Fprint(d.w, d.line)
+	}
+	return n, err
+}
+
+func (d *ProgressDisplay) render() {
+	s := d.progress.Snapshot()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if elapsed := now.Sub(d.lastAt).Seconds(); elapsed > 0 {
+		rate := float64(s.Read-d.lastRead) / elapsed
+		// 表示が揺れないよう直近の値を平滑化する
+		if d.rate == 0 {
+			d.rate = rate
+		} else {
+			d.rate = d.rate*0.7 + rate*0.3
+		}
+	}
+	d.lastRead, d.lastAt = s.Read, now
+	d.clear()
+	d.line = fmt.Sprintf("%s: %s", d.label, s.format(d.rate))
+	fmt.Fprint(d.w, d.line)
+}
+
+// clear : 表示中の進捗の行を消す
+func (d *ProgressDisplay) clear() {
+	if d.line != "" {
+		fmt.Fprint(d.w, "\r\033[K")
+	}
+}
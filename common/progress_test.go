@@ -0,0 +1,97 @@
+package kb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tsubasaxZZZ/wutools/common/kbtest"
+)
+
+// TestDownloadAllKBProgress : ダウンロードの進捗。再開した場合の既存の部分は転送済みに含め、この実行の転送量には含めない
+func TestDownloadAllKBProgress(t *testing.T) {
+	_, list, dir := newTestKBList(t)
+	payload := kbtest.Payload(testMsuName)
+	offset := len(payload) / 3
+	if err := os.WriteFile(filepath.Join(dir, testMsuName+partialSuffix), payload[:offset], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	progress := NewProgress()
+	if err := list.DownloadAllKB(context.Background(), 2, DownloadOptions{OutDir: dir, Progress: progress}); err != nil {
+		t.Fatalf("DownloadAllKB error = %v", err)
+	}
+	var total int64
+	for _, name := range []string{testMsuName, testPsfName, "windows10.0-kb4103723-x86_8b1d0c9e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b2c.msu"} {
+		total += int64(kbtest.Payloads[name])
+	}
+	s := progress.Snapshot()
+	if s.Files != 3 || s.Completed != 3 || s.Active != 0 {
+		t.Errorf("Snapshot = {Files: %d, Completed: %d, Active: %d}, want {3, 3, 0}", s.Files, s.Completed, s.Active)
+	}
+	if s.Total != total || s.Transferred != total || s.Read != total-int64(offset) {
+		t.Errorf("Snapshot = {Total: %d, Transferred: %d, Read: %d}, want {%d, %d, %d}", s.Total, s.Transferred, s.Read, total, total, total-int64(offset))
+	}
+	if s.Percent() != 100 {
+		t.Errorf("Percent() = %v, want 100", s.Percent())
+	}
+
+	// 完了したファイルは最後の1回だけ返す
+	if got := len(progress.Changed()); got != 3 {
+		t.Errorf("len(Changed()) = %d, want 3", got)
+	}
+	if got := len(progress.Changed()); got != 0 {
+		t.Errorf("len(Changed()) = %d, want 0", got)
+	}
+}
+
+// TestProgressNil : nil の Progress, Transfer は何もしない
+func TestProgressNil(t *testing.T) {
+	var p *Progress
+	p.Plan(&PackageFile{FileSize: 1})
+	tr := p.Start(nil, nil)
+	tr.Set(10)
+	tr.Add(10)
+	tr.Done()
+	if tr.Transferred() != 0 || p.Snapshot() != (ProgressSnapshot{}) || len(p.Changed()) != 0 {
+		t.Error("nil Progress must not record anything")
+	}
+}
+
+// TestProgressSnapshotPercent : 合計サイズが不明な場合は -1、転送済みが合計を超えても 100
+func TestProgressSnapshotPercent(t *testing.T) {
+	tests := []struct {
+		s    ProgressSnapshot
+		want float64
+	}{
+		{s: ProgressSnapshot{Total: 200, Transferred: 50}, want: 25},
+		{s: ProgressSnapshot{Total: 0, Transferred: 50}, want: -1},
+		{s: ProgressSnapshot{Total: 100, Transferred: 150}, want: 100},
+	}
+	for _, tt := range tests {
+		if got := tt.s.Percent(); got != tt.want {
+			t.Errorf("Percent(%+v) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+// TestFormatBytes : バイト数の表示
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{n: 0, want: "0 B"},
+		{n: 1023, want: "1023 B"},
+		{n: 1024, want: "1.0 KiB"},
+		{n: 1536, want: "1.5 KiB"},
+		{n: 5 * 1024 * 1024, want: "5.0 MiB"},
+		{n: 3 << 30, want: "3.0 GiB"},
+	}
+	for _, tt := range tests {
+		if got := FormatBytes(tt.n); got != tt.want {
+			t.Errorf("FormatBytes(%d) = %s, want %s", tt.n, got, tt.want)
+		}
+	}
+}
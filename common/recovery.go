@@ -0,0 +1,112 @@
+package kb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// ErrInterrupted : デーモンの停止によりセッションの処理を中断した
+var ErrInterrupted = errors.New("session interrupted")
+
+// InProgressStatuses : 処理中の状態。デーモンが異常終了した場合にこの状態のまま残る
+// ダウンロード完了は、アップロード中に変更する前に異常終了した場合に残る
+var InProgressStatuses = []int{StatusMetadataInprogress, StatusDownloadInprogress, StatusDownloadComplete, StatusUploadInprogress}
+
+// DownloadPendingCondition : メタデータ取得完了のまま中断した、ダウンロードする(SAキーがある)はずだったセッションの条件(引数は StautsMetadataComplete)
+// SAキーがないセッションはメタデータ取得完了で処理を終えるため、中断したセッションとみなさない
+const DownloadPendingCondition = "(status = ? AND saname <> '' AND sakey <> '')"
+
+// StaleCondition : 中断したセッションの条件(session テーブルの WHERE 句)
+// リースの期限切れ、またはリースのない(リース導入前のデーモンが処理した)セッションで最終更新日時が引数の日時より前のもの
+const StaleCondition = "(lease_expires_utc < UTC_TIMESTAMP() OR (lease_expires_utc IS NULL AND update_utc_date < ?))"
+
+// interrupted : 処理を中断した(ctx が終了した)セッションの状態に中断を記録する
+// リースを失った(他のワーカーが処理している)場合は記録しない
+func (session *Session) interrupted(ctx context.Context) error {
+	cause := context.Cause(ctx)
+	if errors.Is(cause, ErrLeaseLost) {
+		return cause
+	}
+	session.ChangeStatus(session.Status | StatusInterrupted)
+	return fmt.Errorf("%w: id=[%s], kbno=[%d], status=[%d]: %v", ErrInterrupted, session.ID.String, session.Kbno, session.Status, cause)
+}
+
+// deletePackages : セッションの KB のパッケージを package テーブルから削除する
+func (session *Session) deletePackages() {
+	_, err := session.Db.Exec("DELETE FROM package WHERE session_id = ? AND kbno = ?", session.ID, session.Kbno)
+	if err != nil {
+		log.Printf("DELETE ERROR: id=[%s], kbno=[%d], error=[%v]", session.ID.String, session.Kbno, err)
+	}
+}
+
+// loadPackages : package テーブルに格納済みのパッケージの情報から KB 情報を復元する(中断したセッションの再開に使用する)
+// ファイルの状態も復元するため、完了したダウンロード・アップロードはやり直さない
+func (session *Session) loadPackages() (*KB, error) {
+	rows, err := session.Db.Query(
+		"SELECT title, downloadLink, architecture, fileName, language, fileSize, digest, products, classification, version, filter_reason, status "+
+			"FROM package WHERE session_id = ? AND kbno = ? ORDER BY id",
+		session.ID, session.Kbno,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	kbinfo := &KB{no: session.Kbno}
+	pkgs := map[string]*PackageInfo{}
+	filtered := map[string]*FilteredPackage{}
+	for rows.Next() {
+		var title, link, arch, name, lang, digest, products, classification, version, reason sql.NullString
+		var size sql.NullInt64
+		var status int
+		if err := rows.Scan(&title, &link, &arch, &name, &lang, &size, &digest, &products, &classification, &version, &reason, &status); err != nil {
+			return nil, err
+		}
+		file := &PackageFile{
+			DownloadLink: link.String,
+			Architecture: arch.String,
+			FileName:     name.String,
+			Language:     lang.String,
+			FileSize:     size.Int64,
+			Digest:       digest.String,
+			Status:       status,
+		}
+		if status == StatusFiltered {
+			f, ok := filtered[title.String]
+			if !ok {
+				f = &FilteredPackage{Package: &PackageInfo{Title: title.String, Products: products.String, Classification: classification.String, Version: version.String}, Reason: reason.String}
+				filtered[title.String] = f
+				kbinfo.Filtered = append(kbinfo.Filtered, f)
+			}
+			f.Package.Files = append(f.Package.Files, file)
+			continue
+		}
+		pkg, ok := pkgs[title.String]
+		if !ok {
+			pkg = &PackageInfo{Title: title.String, Products: products.String, Classification: classification.String, Version: version.String}
+			pkgs[title.String] = pkg
+			kbinfo.PackageInfos = append(kbinfo.PackageInfos, pkg)
+		}
+		pkg.Files = append(pkg.Files, file)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	log.Printf("Load package information: id=[%s], kbno=[%d], packages=[%d], filtered=[%d]", session.ID.String, session.Kbno, len(kbinfo.PackageInfos), len(kbinfo.Filtered))
+	return kbinfo, nil
+}
+
+// downloadedBefore : 中断したセッションの再開時に、前回までにダウンロード(またはアップロード)が完了しているファイルかどうか
+// ダウンロード済みの状態でも、ファイルが存在しない・検証に失敗した場合(コンテナの再作成など)はダウンロードし直す
+func downloadedBefore(file *PackageFile, filePath string) bool {
+	switch file.Status {
+	case StatusUploadComplete, StatusDownloadSkip:
+		return true
+	case StatusDownloadComplete, StatusUploadInprogress:
+		return existsVerifiedFile(file, filePath)
+	}
+	return false
+}
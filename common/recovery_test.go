@@ -0,0 +1,51 @@
+package kb
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestDownloadedBefore : 再開時にダウンロードをやり直さないファイル
+// ダウンロード済みの状態でも、ファイルが存在しない・検証に失敗した場合はやり直す
+func TestDownloadedBefore(t *testing.T) {
+	content := []byte("windows update package")
+	sum := sha1.Sum(content)
+	digest := base64.StdEncoding.EncodeToString(sum[:])
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing.msu")
+	if err := os.WriteFile(existing, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tampered := filepath.Join(dir, "tampered.msu")
+	if err := os.WriteFile(tampered, []byte("windows update packagX"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing.msu")
+
+	tests := []struct {
+		name     string
+		status   int
+		filePath string
+		want     bool
+	}{
+		{name: "upload complete", status: StatusUploadComplete, filePath: missing, want: true},
+		{name: "download skip", status: StatusDownloadSkip, filePath: missing, want: true},
+		{name: "download complete", status: StatusDownloadComplete, filePath: existing, want: true},
+		{name: "download complete but missing", status: StatusDownloadComplete, filePath: missing, want: false},
+		{name: "download complete but tampered", status: StatusDownloadComplete, filePath: tampered, want: false},
+		{name: "upload in progress", status: StatusUploadInprogress, filePath: existing, want: true},
+		{name: "download in progress", status: StatusDownloadInprogress, filePath: existing, want: false},
+		{name: "error", status: StatusError, filePath: existing, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := &PackageFile{FileName: filepath.Base(tt.filePath), FileSize: int64(len(content)), Digest: digest, Status: tt.status}
+			if got := downloadedBefore(file, tt.filePath); got != tt.want {
+				t.Errorf("downloadedBefore = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package kb
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy : カタログ・ダウンロードの HTTP 呼び出しの再試行ポリシー
+type RetryPolicy struct {
+	// MaxAttempts : 最大試行回数(1 の場合は再試行しない)
+	MaxAttempts int
+	// BaseDelay : 1回目の再試行までの待ち時間。以降は倍々に増やす
+	BaseDelay time.Duration
+	// MaxDelay : 再試行までの待ち時間の上限
+	MaxDelay time.Duration
+	// RequestTimeout : カタログへの1回のリクエストのタイムアウト。ダウンロードの場合はレスポンスヘッダ受信までのタイムアウト
+	RequestTimeout time.Duration
+	// PackageTimeout : 1パッケージあたりの処理(メタデータ取得、ファイルのダウンロード)の期限
+	PackageTimeout time.Duration
+}
+
+// DefaultRetryPolicy : 既定の再試行ポリシー
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	BaseDelay:      2 * time.Second,
+	MaxDelay:       2 * time.Minute,
+	RequestTimeout: 60 * time.Second,
+	PackageTimeout: 2 * time.Hour,
+}
+
+// Do : fn を再試行可能なエラーの間、最大試行回数まで繰り返す
+// fn には試行回数(1 始まり)が渡される
+func (policy RetryPolicy) Do(ctx context.Context, op string, fn func(ctx context.Context, attempt int) error) error {
+	maxAttempts := policy.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if err = fn(ctx, attempt); err == nil {
+			return nil
+		}
+		if !IsRetryable(err) || attempt == maxAttempts {
+			break
+		}
+		delay := policy.backoff(attempt, err)
+		log.Printf("Retry: op=[%s], attempt=[%d/%d], delay=[%s], error=[%v]", op, attempt, maxAttempts, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return err
+}
+
+// backoff : attempt 回目の失敗後の待ち時間
+// Retry-After の指定があればそれに従い、なければ指数バックオフ(ジッタあり)
+func (policy RetryPolicy) backoff(attempt int, err error) time.Duration {
+	var reqErr *RequestError
+	if errors.As(err, &reqErr) && reqErr.RetryAfter > 0 {
+		if policy.MaxDelay > 0 && reqErr.RetryAfter > policy.MaxDelay {
+			return policy.MaxDelay
+		}
+		return reqErr.RetryAfter
+	}
+	delay := policy.BaseDelay
+	for i := 1; i < attempt && (policy.MaxDelay <= 0 || delay < policy.MaxDelay); i++ {
+		delay *= 2
+	}
+	if policy.MaxDelay > 0 && delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	// 待ち時間の 50% - 100% の範囲でばらつかせる
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// withPackageTimeout : 1パッケージあたりの期限を設定する
+func (policy RetryPolicy) withPackageTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if policy.PackageTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, policy.PackageTimeout)
+}
+
+// doRequest : カタログへのリクエストを1回実行する。タイムアウトはレスポンスの読み込み完了までを含む
+// レスポンスボディは read に渡され、呼び出し後に閉じられる
+func (policy RetryPolicy) doRequest(ctx context.Context, client *http.Client, op string, req *http.Request, read func(resp *http.Response) error) error {
+	if policy.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.RequestTimeout)
+		defer cancel()
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return newTransportError(op, req.URL.String(), err)
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(op, resp); err != nil {
+		return err
+	}
+	if err := read(resp); err != nil {
+		// ボディの読み込み中の切断・タイムアウト
+		var reqErr *RequestError
+		if !errors.As(err, &reqErr) {
+			return newTransportError(op, req.URL.String(), err)
+		}
+		return err
+	}
+	return nil
+}
+
+// doStream : ダウンロードのリクエストを実行する。タイムアウトはレスポンスヘッダの受信までで、ボディの読み込みは含まない
+// ステータスコードの確認は呼び出し元で行う。呼び出し元は cancel を呼び出してレスポンスを閉じること
+func (policy RetryPolicy) doStream(ctx context.Context, client *http.Client, op string, req *http.Request) (*http.Response, context.CancelFunc, error) {
+	reqCtx, cancel := context.WithCancel(ctx)
+	timedOut := false
+	var timer *time.Timer
+	if policy.RequestTimeout > 0 {
+		timer = time.AfterFunc(policy.RequestTimeout, cancel)
+	}
+	resp, err := client.Do(req.WithContext(reqCtx))
+	if timer != nil && !timer.Stop() {
+		timedOut = true
+		if err == nil {
+			resp.Body.Close()
+		}
+		err = context.DeadlineExceeded
+	}
+	if err != nil {
+		cancel()
+		if timedOut || ctx.Err() == nil {
+			return nil, nil, newTransportError(op, req.URL.String(), err)
+		}
+		return nil, nil, err
+	}
+	return resp, func() {
+		resp.Body.Close()
+		cancel()
+	}, nil
+}
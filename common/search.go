@@ -0,0 +1,114 @@
+package kb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// SearchKBs : 任意の検索語(製品名、更新プログラムの名前など)でカタログを検索し、KB 番号ごとにまとめて返す
+// KB 番号はタイトルから取得する。タイトルに KB 番号がない更新プログラムは KB 番号 0 にまとめる
+// KB の順序は検索結果に最初に現れた順。検索結果が0件の場合は ErrNoCatalogHits を返す
+func SearchKBs(ctx context.Context, query string, opts BuildOptions) ([]*KB, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, errors.New("empty search query")
+	}
+	result, err := DefaultCatalog.Search(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("query=[%s]: %w", query, err)
+	}
+	if len(result.Packages) == 0 {
+		return nil, fmt.Errorf("query=[%s]: %w", query, ErrNoCatalogHits)
+	}
+	log.Printf("Search catalog: query=[%s], total=[%d], pages=[%d], packages=[%d]", query, result.Total, result.Pages, len(result.Packages))
+
+	if err := buildPackages(ctx, result.Packages, opts); err != nil {
+		return nil, fmt.Errorf("query=[%s], %w", query, err)
+	}
+
+	kbs := []*KB{}
+	byNo := map[int]*KB{}
+	for _, packageInfo := range result.Packages {
+		no := KBNoFromTitle(packageInfo.Title)
+		kb, ok := byNo[no]
+		if !ok {
+			kb = &KB{no: no, hits: result.Total, query: query}
+			byNo[no] = kb
+			kbs = append(kbs, kb)
+		}
+		kb.PackageInfos = append(kb.PackageInfos, packageInfo)
+	}
+	for _, kb := range kbs {
+		kb.applyFilter(opts.Filter.Evaluate)
+		if opts.Article {
+			kb.Article = fetchArticle(ctx, kb.no)
+		}
+	}
+	return kbs, nil
+}
+
+// NewKBListFromQueries : 検索語の検索結果から KB のリストを生成する
+// 複数の検索語に同じ KB が含まれる場合は1つにまとめ、同じ更新プログラムは重複させない
+// 結果は検索語の順、検索結果の順で格納される。検索に失敗した検索語は KBResult.Err に記録し、全てのエラーをまとめたものを返す
+func NewKBListFromQueries(ctx context.Context, queries []string, maxConcurrent int, opts BuildOptions) (*KBList, error) {
+	type queryResult struct {
+		kbs []*KB
+		err error
+	}
+	// goroutine ごとに書き込み先のインデックスを分けるため、ロックは不要
+	queryResults := make([]queryResult, len(queries))
+
+	wg := &sync.WaitGroup{}
+	semaphore := make(chan int, maxConcurrent)
+	for i, query := range queries {
+		wg.Add(1)
+		go func(i int, query string) {
+			defer wg.Done()
+			semaphore <- 1
+			defer func() { <-semaphore }()
+			kbs, err := SearchKBs(ctx, query, opts)
+			if err != nil {
+				log.Printf("Search catalog error: query=[%s], error=[%v]", query, err)
+			}
+			queryResults[i] = queryResult{kbs: kbs, err: err}
+		}(i, query)
+	}
+	wg.Wait()
+
+	kbList := &KBList{}
+	byNo := map[int]*KB{}
+	seen := map[string]bool{}
+	for i, qr := range queryResults {
+		if qr.err != nil {
+			kbList.results = append(kbList.results, KBResult{Query: queries[i], Err: qr.err})
+			continue
+		}
+		for _, kb := range qr.kbs {
+			merged, ok := byNo[kb.no]
+			if !ok {
+				merged = &KB{no: kb.no, hits: kb.hits, query: kb.query, Article: kb.Article}
+				byNo[kb.no] = merged
+				kbList.results = append(kbList.results, KBResult{No: kb.no, Query: kb.query, KB: merged})
+			}
+			for _, packageInfo := range kb.PackageInfos {
+				if seen[packageInfo.UpdateID] {
+					continue
+				}
+				seen[packageInfo.UpdateID] = true
+				merged.PackageInfos = append(merged.PackageInfos, packageInfo)
+			}
+			for _, filtered := range kb.Filtered {
+				if seen[filtered.Package.UpdateID] {
+					continue
+				}
+				seen[filtered.Package.UpdateID] = true
+				merged.Filtered = append(merged.Filtered, filtered)
+			}
+		}
+	}
+	return kbList, kbList.Err()
+}
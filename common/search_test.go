@@ -0,0 +1,93 @@
+package kb
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// TestKBNoFromTitle : タイトル中の KB 番号の表記
+func TestKBNoFromTitle(t *testing.T) {
+	tests := []struct {
+		title string
+		want  int
+	}{
+		{title: "2018-05 Cumulative Update for Windows 10 Version 1607 for x86-based Systems (KB4103723)", want: 4103723},
+		{title: "Security Intelligence Update for Windows Defender Antivirus - KB2267602 (Version 1.269.1084.0)", want: 2267602},
+		{title: "Windows Malicious Software Removal Tool x64 - v5.60 (KB890830)", want: 890830},
+		{title: "Intel - System - 10.1.1.38", want: 0},
+		{title: "Update for XKB4103723", want: 0},
+	}
+	for _, tt := range tests {
+		if got := KBNoFromTitle(tt.title); got != tt.want {
+			t.Errorf("KBNoFromTitle(%q) = %d, want %d", tt.title, got, tt.want)
+		}
+	}
+}
+
+// TestSearchKBs : 検索語の検索結果を、タイトルの KB 番号ごとにまとめる
+func TestSearchKBs(t *testing.T) {
+	newTestCatalog(t)
+
+	kbs, err := SearchKBs(context.Background(), " Cumulative Update for Windows 10 ", BuildOptions{})
+	if err != nil {
+		t.Fatalf("SearchKBs error = %v", err)
+	}
+	wantNos := []int{4103723, 4093105}
+	if len(kbs) != len(wantNos) {
+		t.Fatalf("len(kbs) = %d, want %d", len(kbs), len(wantNos))
+	}
+	for i, no := range wantNos {
+		kb := kbs[i]
+		if kb.No() != no || kb.Query() != "Cumulative Update for Windows 10" || kb.Hits() != 2 {
+			t.Errorf("kbs[%d] = {No: %d, Query: %q, Hits: %d}, want {No: %d, Query: %q, Hits: 2}", i, kb.No(), kb.Query(), kb.Hits(), no, "Cumulative Update for Windows 10")
+		}
+		if len(kb.PackageInfos) != 1 || len(kb.PackageInfos[0].Files) == 0 {
+			t.Errorf("kbs[%d] packages = %v, want 1 package with files", i, kb.PackageInfos)
+		}
+	}
+}
+
+// TestSearchKBsError : 空の検索語、該当なしの場合はエラー
+func TestSearchKBsError(t *testing.T) {
+	newTestCatalog(t)
+
+	if _, err := SearchKBs(context.Background(), "  ", BuildOptions{}); err == nil {
+		t.Error("SearchKBs(empty) error = nil, want error")
+	}
+	if _, err := SearchKBs(context.Background(), "nothing here", BuildOptions{}); !errors.Is(err, ErrNoCatalogHits) {
+		t.Errorf("SearchKBs(no result) error = %v, want %v", err, ErrNoCatalogHits)
+	}
+}
+
+// TestNewKBListFromQueries : 複数の検索語の同じ KB は1つにまとめ、同じ更新プログラムは重複させない
+func TestNewKBListFromQueries(t *testing.T) {
+	newTestCatalog(t)
+
+	queries := []string{"Cumulative Update for Windows 10", "nothing here", "4103723"}
+	list, err := NewKBListFromQueries(context.Background(), queries, 2, BuildOptions{})
+	if !errors.Is(err, ErrNoCatalogHits) {
+		t.Fatalf("NewKBListFromQueries error = %v, want %v", err, ErrNoCatalogHits)
+	}
+
+	results := list.Results()
+	if len(results) != 3 {
+		t.Fatalf("len(Results()) = %d, want 3", len(results))
+	}
+	if results[0].No != 4103723 || results[1].No != 4093105 {
+		t.Errorf("Results() = [%d %d], want [4103723 4093105]", results[0].No, results[1].No)
+	}
+	if results[2].Query != "nothing here" || results[2].KB != nil || !errors.Is(results[2].Err, ErrNoCatalogHits) {
+		t.Errorf("Results()[2] = %+v, want error of %q", results[2], "nothing here")
+	}
+
+	// KB4103723 は1つ目の検索語の x86 と3つ目の検索語の x64 をまとめる
+	ids := []string{}
+	for _, p := range results[0].KB.PackageInfos {
+		ids = append(ids, p.UpdateID)
+	}
+	want := []string{"6b4b8a8f-0a5a-4a8b-9a1b-3f1d3c2e4a02", "6b4b8a8f-0a5a-4a8b-9a1b-3f1d3c2e4a01"}
+	if len(ids) != len(want) || ids[0] != want[0] || ids[1] != want[1] {
+		t.Errorf("KB4103723 packages = %v, want %v", ids, want)
+	}
+}
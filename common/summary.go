@@ -0,0 +1,119 @@
+package kb
+
+import (
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+// RunSummary : 実行結果のまとめ。KB、パッケージ、ファイルごとのダウンロード結果
+type RunSummary struct {
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	// ExitCode : コマンドの終了コード。呼び出し側で設定する
+	ExitCode int `json:"exitCode"`
+	// Succeeded, Failed : ダウンロード(スキップを含む)に成功・失敗したファイルの数。取得に失敗した KB は Failed に含める
+	Succeeded int         `json:"succeeded"`
+	Failed    int         `json:"failed"`
+	KBs       []KBSummary `json:"kbs"`
+}
+
+// KBSummary : KB ごとの実行結果。取得に失敗した場合は Error が設定される
+type KBSummary struct {
+	KB int `json:"kb"`
+	// Title : サポート技術情報の記事のタイトル。取得していない場合は空
+	Title    string           `json:"title,omitempty"`
+	Query    string           `json:"query,omitempty"`
+	Error    string           `json:"error,omitempty"`
+	Packages []PackageSummary `json:"packages"`
+}
+
+// PackageSummary : パッケージごとの実行結果
+type PackageSummary struct {
+	UpdateID string `json:"updateId"`
+	Title    string `json:"title"`
+	// Filtered : 絞り込み条件で対象外になった理由
+	Filtered string        `json:"filtered,omitempty"`
+	Files    []FileSummary `json:"files"`
+}
+
+// FileSummary : ファイルごとの実行結果
+type FileSummary struct {
+	FileName string `json:"fileName"`
+	// Path : ダウンロード先の絶対パス。ダウンロードしていない場合は空
+	Path   string `json:"path,omitempty"`
+	Size   int64  `json:"size"`
+	Digest string `json:"digest"`
+	// Status : downloaded, skipped(ダウンロード済み), error, filtered, pending(未実行)
+	Status string `json:"status"`
+}
+
+// fileStatusName : ファイルの状態の名前
+func fileStatusName(status int) string {
+	switch status {
+	case StatusDownloadComplete:
+		return "downloaded"
+	case StatusDownloadSkip:
+		return "skipped"
+	case StatusError:
+		return "error"
+	case StatusFiltered:
+		return "filtered"
+	}
+	return "pending"
+}
+
+// Summary : KB のリストの実行結果をまとめる
+func (kbList KBList) Summary(startedAt time.Time) *RunSummary {
+	summary := &RunSummary{StartedAt: startedAt, FinishedAt: time.Now(), KBs: []KBSummary{}}
+	for _, result := range kbList.results {
+		kbSummary := KBSummary{KB: result.No, Query: result.Query, Packages: []PackageSummary{}}
+		if result.Err != nil {
+			kbSummary.Error = result.Err.Error()
+			summary.Failed++
+			summary.KBs = append(summary.KBs, kbSummary)
+			continue
+		}
+		kbSummary.Title = result.KB.Title()
+		add := func(pkg *PackageInfo, filtered string) {
+			pkgSummary := PackageSummary{UpdateID: pkg.UpdateID, Title: pkg.Title, Filtered: filtered, Files: []FileSummary{}}
+			for _, file := range pkg.Files {
+				fileSummary := FileSummary{FileName: file.FileName, Size: file.FileSize, Digest: file.Digest, Status: fileStatusName(file.Status)}
+				if filtered != "" {
+					fileSummary.Status = fileStatusName(StatusFiltered)
+				} else {
+					switch file.Status {
+					case StatusDownloadComplete, StatusDownloadSkip:
+						summary.Succeeded++
+					default:
+						summary.Failed++
+					}
+				}
+				if file.LocalPath != "" {
+					fileSummary.Path = file.LocalPath
+					if abs, err := filepath.Abs(file.LocalPath); err == nil {
+						fileSummary.Path = abs
+					}
+				}
+				pkgSummary.Files = append(pkgSummary.Files, fileSummary)
+			}
+			kbSummary.Packages = append(kbSummary.Packages, pkgSummary)
+		}
+		for _, pkg := range result.KB.PackageInfos {
+			add(pkg, "")
+		}
+		for _, filtered := range result.KB.Filtered {
+			add(filtered.Package, filtered.Reason)
+		}
+		summary.KBs = append(summary.KBs, kbSummary)
+	}
+	return summary
+}
+
+// WriteJSON : 実行結果を JSON で出力する
+func (summary *RunSummary) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(summary)
+}
@@ -0,0 +1,381 @@
+package kb
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// maxSupersedenceDepth : 置き換え関係を辿る深さの上限
+const maxSupersedenceDepth = 100
+
+// SupersedenceTree : KB の更新プログラムごとの置き換え関係の木
+type SupersedenceTree struct {
+	No int
+	// Roots : KB の更新プログラム(製品・アーキテクチャごと)
+	Roots []*SupersedenceNode
+}
+
+// SupersedenceNode : 置き換え関係の木のノード。SupersededBy の先がより新しい更新プログラム
+type SupersedenceNode struct {
+	// Package : 起点の KB の更新プログラムは検索結果の情報、それ以外は詳細ページの情報(Title, UpdateID, Products, Classification, Details)のみ
+	// 最新の更新プログラムをダウンロードする場合は Files も設定される
+	Package *PackageInfo
+	// KBNo : タイトルの KB 番号。ない場合は 0
+	KBNo         int
+	SupersededBy []*SupersedenceNode
+}
+
+// IsLeaf : 置き換える更新プログラムがないかどうか
+// 置き換え先には別の製品・アーキテクチャの更新プログラムも含まれるため、最新かどうかは Latest で判断する
+func (node *SupersedenceNode) IsLeaf() bool {
+	return len(node.SupersededBy) == 0
+}
+
+// ResolveSupersedence : KB の更新プログラムから詳細ページの「置き換え先」を辿り、最新の更新プログラムまでの木を生成する
+// 起点の更新プログラムには opts.Filter が適用される
+func ResolveSupersedence(ctx context.Context, no int, opts BuildOptions) (*SupersedenceTree, error) {
+	opts.Details = true
+	kb, err := BuildKBInfo(ctx, no, opts)
+	if err != nil {
+		return nil, err
+	}
+	tree := &SupersedenceTree{No: no}
+	resolved := map[string]*SupersedenceNode{}
+	for _, p := range kb.PackageInfos {
+		root := &SupersedenceNode{Package: p, KBNo: KBNoFromTitle(p.Title)}
+		resolved[p.UpdateID] = root
+		if err := resolveSupersededBy(ctx, root, resolved, map[string]bool{p.UpdateID: true}, 1); err != nil {
+			return nil, fmt.Errorf("kb=[%d], %w", no, err)
+		}
+		tree.Roots = append(tree.Roots, root)
+	}
+	return tree, nil
+}
+
+// resolveSupersededBy : node を置き換える更新プログラムを再帰的に取得する
+// resolved は取得済みのノード(複数の更新プログラムが同じ更新プログラムに置き換えられる場合に共有する)
+// path は起点からのノード。循環している場合は辿らない
+func resolveSupersededBy(ctx context.Context, node *SupersedenceNode, resolved map[string]*SupersedenceNode, path map[string]bool, depth int) error {
+	if node.Package.Details == nil {
+		return nil
+	}
+	for _, ref := range node.Package.Details.SupersededBy {
+		if ref.UpdateID == "" {
+			log.Printf("Superseding update has no update ID. skip.. : updateID=[%s], title=[%s]", node.Package.UpdateID, ref.Title)
+			continue
+		}
+		if path[ref.UpdateID] {
+			log.Printf("Supersedence is circular. skip.. : updateID=[%s], supersededBy=[%s]", node.Package.UpdateID, ref.UpdateID)
+			continue
+		}
+		if child, ok := resolved[ref.UpdateID]; ok {
+			node.SupersededBy = append(node.SupersededBy, child)
+			continue
+		}
+		if depth >= maxSupersedenceDepth {
+			log.Printf("Supersedence chain exceeds the limit. stop.. : updateID=[%s], depth=[%d]", node.Package.UpdateID, depth)
+			return nil
+		}
+
+		log.Printf("Get superseding update: updateID=[%s], supersededBy=[%s], title=[%s]", node.Package.UpdateID, ref.UpdateID, ref.Title)
+		details, err := DefaultCatalog.Details(ctx, ref.UpdateID)
+		if err != nil {
+			return fmt.Errorf("updateID=[%s]: %w", ref.UpdateID, err)
+		}
+		child := &SupersedenceNode{
+			Package: &PackageInfo{Title: ref.Title, UpdateID: ref.UpdateID, Products: details.Products, Classification: details.Classification, Details: details},
+			KBNo:    ref.KBNo,
+		}
+		resolved[ref.UpdateID] = child
+		node.SupersededBy = append(node.SupersededBy, child)
+
+		path[ref.UpdateID] = true
+		err = resolveSupersededBy(ctx, child, resolved, path, depth+1)
+		delete(path, ref.UpdateID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SupersedenceEntry : 木のノードを1回ずつ列挙した要素
+type SupersedenceEntry struct {
+	Node *SupersedenceNode
+	// Depth : 起点の更新プログラムからの最短の深さ
+	Depth int
+	// Parents : このノードに置き換えられる更新プログラム(木の親)。起点の更新プログラムは空
+	Parents []*SupersedenceNode
+}
+
+// Nodes : 木のノードを起点から近い順に1回ずつ列挙する
+// 複数の更新プログラムから置き換えられる更新プログラムも1回だけ含め、親は Parents にまとめる
+func (tree *SupersedenceTree) Nodes() []*SupersedenceEntry {
+	entries := []*SupersedenceEntry{}
+	byID := map[string]*SupersedenceEntry{}
+	for _, root := range tree.Roots {
+		if _, ok := byID[root.Package.UpdateID]; ok {
+			continue
+		}
+		entry := &SupersedenceEntry{Node: root}
+		byID[root.Package.UpdateID] = entry
+		entries = append(entries, entry)
+	}
+	// entries を幅優先のキューとして使う
+	for i := 0; i < len(entries); i++ {
+		parent := entries[i]
+		for _, child := range parent.Node.SupersededBy {
+			if entry, ok := byID[child.Package.UpdateID]; ok {
+				entry.Parents = append(entry.Parents, parent.Node)
+				continue
+			}
+			entry := &SupersedenceEntry{Node: child, Depth: parent.Depth + 1, Parents: []*SupersedenceNode{parent.Node}}
+			byID[child.Package.UpdateID] = entry
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// updateGroup : 更新プログラムの製品・アーキテクチャ。不明な項目は空
+type updateGroup struct {
+	arch     string
+	products []string
+}
+
+// newUpdateGroup : ファイル、詳細ページ、タイトルの順に製品・アーキテクチャを判断する
+func newUpdateGroup(p *PackageInfo) updateGroup {
+	g := updateGroup{}
+	for _, file := range p.Files {
+		if file.Architecture != "" {
+			g.arch = normalizeArchitecture(file.Architecture)
+			break
+		}
+	}
+	if g.arch == "" && p.Details != nil && p.Details.Architecture != "" {
+		g.arch = normalizeArchitecture(p.Details.Architecture)
+	}
+	if g.arch == "" {
+		title := strings.ToLower(p.Title)
+		for alias, v := range architectureAliases {
+			if strings.Contains(title, alias+"-based") {
+				g.arch = v
+				break
+			}
+		}
+	}
+	products := p.Products
+	if products == "" && p.Details != nil {
+		products = p.Details.Products
+	}
+	for _, product := range strings.Split(products, ",") {
+		if product = strings.ToLower(strings.TrimSpace(product)); product != "" {
+			g.products = append(g.products, product)
+		}
+	}
+	return g
+}
+
+// matches : 製品・アーキテクチャが同じかどうか。どちらかが不明な項目は比較しない
+// 製品は複数の場合、いずれかが一致すれば同じとみなす
+func (g updateGroup) matches(other updateGroup) bool {
+	if g.arch != "" && other.arch != "" && g.arch != other.arch {
+		return false
+	}
+	if len(g.products) == 0 || len(other.products) == 0 {
+		return true
+	}
+	for _, a := range g.products {
+		for _, b := range other.products {
+			if a == b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Latest : node から辿れる更新プログラムのうち、node と同じ製品・アーキテクチャで、
+// 同じ製品・アーキテクチャの更新プログラムに置き換えられていないもの(最新の更新プログラム)
+// 置き換え先には別の製品・アーキテクチャの更新プログラムも含まれるため、木の葉とは限らない
+func (node *SupersedenceNode) Latest() []*SupersedenceNode {
+	group := newUpdateGroup(node.Package)
+	latest := []*SupersedenceNode{}
+	// found : ノードとその置き換え先に同じ製品・アーキテクチャの更新プログラムがあるかどうか(辿り済みのノードのメモ)
+	found := map[string]bool{}
+	var walk func(n *SupersedenceNode) bool
+	walk = func(n *SupersedenceNode) bool {
+		if v, ok := found[n.Package.UpdateID]; ok {
+			return v
+		}
+		found[n.Package.UpdateID] = false
+		superseded := false
+		for _, child := range n.SupersededBy {
+			if walk(child) {
+				superseded = true
+			}
+		}
+		matched := group.matches(newUpdateGroup(n.Package))
+		if matched && !superseded {
+			latest = append(latest, n)
+		}
+		found[n.Package.UpdateID] = matched || superseded
+		return matched || superseded
+	}
+	walk(node)
+	return latest
+}
+
+// Leaves : 起点の更新プログラムごとの最新の更新プログラム(Latest)の一覧。重複は除く
+func (tree *SupersedenceTree) Leaves() []*SupersedenceNode {
+	leaves := []*SupersedenceNode{}
+	seen := map[string]bool{}
+	for _, root := range tree.Roots {
+		for _, node := range root.Latest() {
+			if seen[node.Package.UpdateID] {
+				continue
+			}
+			seen[node.Package.UpdateID] = true
+			leaves = append(leaves, node)
+		}
+	}
+	return leaves
+}
+
+// latestUpdateIDs : 最新の更新プログラム(Leaves)の UpdateID
+func (tree *SupersedenceTree) latestUpdateIDs() map[string]bool {
+	ids := map[string]bool{}
+	for _, node := range tree.Leaves() {
+		ids[node.Package.UpdateID] = true
+	}
+	return ids
+}
+
+// LatestKBList : 最新の更新プログラム(Leaves)のファイルの情報を取得し、KB 番号ごとにまとめた KB のリストを生成する
+// 最新の更新プログラムにも opts.Filter を適用し、条件を満たさないものは KB の Filtered に記録する
+// ダウンロード(DownloadAllKB)、メタデータの出力に使用する
+func LatestKBList(ctx context.Context, trees []*SupersedenceTree, opts BuildOptions) (*KBList, error) {
+	kbList := &KBList{}
+	byNo := map[int]*KB{}
+	seen := map[string]bool{}
+	for _, tree := range trees {
+		for _, leaf := range tree.Leaves() {
+			p := leaf.Package
+			if seen[p.UpdateID] {
+				continue
+			}
+			seen[p.UpdateID] = true
+			if p.Files == nil {
+				files, err := DefaultCatalog.PackageFiles(ctx, p.UpdateID)
+				if err != nil {
+					log.Printf("Get latest update files error: kb=[%d], updateID=[%s], error=[%v]", leaf.KBNo, p.UpdateID, err)
+					kbList.results = append(kbList.results, KBResult{No: leaf.KBNo, Err: fmt.Errorf("kb=[%d], updateID=[%s]: %w", leaf.KBNo, p.UpdateID, err)})
+					continue
+				}
+				p.Files = files
+			}
+			kb, ok := byNo[leaf.KBNo]
+			if !ok {
+				kb = &KB{no: leaf.KBNo}
+				byNo[leaf.KBNo] = kb
+				kbList.results = append(kbList.results, KBResult{No: leaf.KBNo, KB: kb})
+			}
+			kb.PackageInfos = append(kb.PackageInfos, p)
+		}
+	}
+	for _, kb := range byNo {
+		kb.applyFilter(opts.Filter.Evaluate)
+	}
+	return kbList, kbList.Err()
+}
+
+// joinUpdateIDs : ノードの UpdateID を "; " 区切りでまとめる
+func joinUpdateIDs(nodes []*SupersedenceNode) string {
+	ids := make([]string, len(nodes))
+	for i, node := range nodes {
+		ids[i] = node.Package.UpdateID
+	}
+	return strings.Join(ids, "; ")
+}
+
+// WriteSupersedenceCSV : 置き換え関係の木を CSV に出力する。1ノード1行で、親の UpdateID と深さで木を表す
+// 複数の更新プログラムから置き換えられる更新プログラムも1行とし、親の UpdateID を "; " 区切りでまとめる
+func WriteSupersedenceCSV(w io.Writer, trees []*SupersedenceTree) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"KB", "Depth", "ParentUpdateIDs", "UpdateID", "UpdateKB", "Title", "MSRCSeverity", "Latest"})
+	for _, tree := range trees {
+		latest := tree.latestUpdateIDs()
+		for _, entry := range tree.Nodes() {
+			node := entry.Node
+			severity := ""
+			if node.Package.Details != nil {
+				severity = node.Package.Details.MSRCSeverity
+			}
+			writer.Write([]string{strconv.Itoa(tree.No), strconv.Itoa(entry.Depth), joinUpdateIDs(entry.Parents), node.Package.UpdateID,
+				strconv.Itoa(node.KBNo), node.Package.Title, severity, strconv.FormatBool(latest[node.Package.UpdateID])})
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// supersedenceJSON : 置き換え関係の木の JSON の形式。ノードは UpdateID で参照する
+type supersedenceJSON struct {
+	KB int `json:"kb"`
+	// Roots : KB の更新プログラムの UpdateID
+	Roots   []string               `json:"roots"`
+	Updates []supersedenceNodeJSON `json:"updates"`
+}
+
+type supersedenceNodeJSON struct {
+	UpdateID        string   `json:"updateId"`
+	KB              int      `json:"kb"`
+	Title           string   `json:"title"`
+	MSRCSeverity    string   `json:"msrcSeverity,omitempty"`
+	Depth           int      `json:"depth"`
+	Latest          bool     `json:"latest"`
+	ParentUpdateIDs []string `json:"parentUpdateIds,omitempty"`
+	SupersededBy    []string `json:"supersededBy,omitempty"`
+}
+
+// WriteSupersedenceJSON : 置き換え関係の木を JSON に出力する。1ノード1件で、親と置き換え先の UpdateID で木を表す
+func WriteSupersedenceJSON(w io.Writer, trees []*SupersedenceTree) error {
+	values := []supersedenceJSON{}
+	for _, tree := range trees {
+		latest := tree.latestUpdateIDs()
+		v := supersedenceJSON{KB: tree.No, Roots: []string{}, Updates: []supersedenceNodeJSON{}}
+		for _, root := range tree.Roots {
+			v.Roots = append(v.Roots, root.Package.UpdateID)
+		}
+		for _, entry := range tree.Nodes() {
+			node := entry.Node
+			u := supersedenceNodeJSON{
+				UpdateID: node.Package.UpdateID,
+				KB:       node.KBNo,
+				Title:    node.Package.Title,
+				Depth:    entry.Depth,
+				Latest:   latest[node.Package.UpdateID],
+			}
+			if node.Package.Details != nil {
+				u.MSRCSeverity = node.Package.Details.MSRCSeverity
+			}
+			for _, parent := range entry.Parents {
+				u.ParentUpdateIDs = append(u.ParentUpdateIDs, parent.Package.UpdateID)
+			}
+			for _, child := range node.SupersededBy {
+				u.SupersededBy = append(u.SupersededBy, child.Package.UpdateID)
+			}
+			v.Updates = append(v.Updates, u)
+		}
+		values = append(values, v)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(values)
+}
@@ -0,0 +1,186 @@
+package kb
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+const (
+	testKB4093105ID = "9c2f1e7d-5b3a-4c6e-8d7f-1a2b3c4d5e03"
+	testKB4103727ID = "9c2f1e7d-5b3a-4c6e-8d7f-1a2b3c4d5e04"
+	testKB4284819ID = "9c2f1e7d-5b3a-4c6e-8d7f-1a2b3c4d5e05"
+	// testKB4284819X86ID : KB4103727(x64) を置き換える別のアーキテクチャの更新プログラム
+	testKB4284819X86ID = "9c2f1e7d-5b3a-4c6e-8d7f-1a2b3c4d5e06"
+)
+
+// updateIDs : ノードの UpdateID の一覧
+func updateIDs(nodes []*SupersedenceNode) []string {
+	ids := []string{}
+	for _, node := range nodes {
+		ids = append(ids, node.Package.UpdateID)
+	}
+	return ids
+}
+
+// TestResolveSupersedence : 詳細ページの置き換え先を辿り、最新は起点と同じ製品・アーキテクチャの更新プログラムとする
+func TestResolveSupersedence(t *testing.T) {
+	newTestCatalog(t)
+
+	tree, err := ResolveSupersedence(context.Background(), 4093105, BuildOptions{})
+	if err != nil {
+		t.Fatalf("ResolveSupersedence error = %v", err)
+	}
+	entries := tree.Nodes()
+	got := []string{}
+	for _, entry := range entries {
+		got = append(got, fmt.Sprintf("%s/%d/%v", entry.Node.Package.UpdateID, entry.Depth, updateIDs(entry.Parents)))
+	}
+	want := []string{
+		testKB4093105ID + "/0/[]",
+		testKB4103727ID + "/1/[" + testKB4093105ID + "]",
+		testKB4284819ID + "/2/[" + testKB4103727ID + "]",
+		testKB4284819X86ID + "/2/[" + testKB4103727ID + "]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Nodes() = %v, want %v", got, want)
+	}
+	// x86 の KB4284819 も木の葉だが、起点(x64)とアーキテクチャが異なるため最新ではない
+	if got := updateIDs(tree.Leaves()); !reflect.DeepEqual(got, []string{testKB4284819ID}) {
+		t.Errorf("Leaves() = %v, want [%s]", got, testKB4284819ID)
+	}
+	if p := entries[2].Node.Package; p.Products != "Windows 10" || p.Details.Architecture != "AMD64" {
+		t.Errorf("Package = {Products: %q, Architecture: %q}, want {Windows 10, AMD64}", p.Products, p.Details.Architecture)
+	}
+}
+
+// TestLatestKBList : 最新の更新プログラムのファイルを取得し、絞り込み条件を満たさないものは Filtered に記録する
+func TestLatestKBList(t *testing.T) {
+	tests := []struct {
+		filter       string
+		wantPackages []string
+		wantFiltered []string
+	}{
+		{filter: "", wantPackages: []string{testKB4284819ID}, wantFiltered: []string{}},
+		{filter: "arch=x64", wantPackages: []string{testKB4284819ID}, wantFiltered: []string{}},
+		{filter: "title!~^2018-06", wantPackages: []string{}, wantFiltered: []string{testKB4284819ID}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			newTestCatalog(t)
+			filter, err := ParseFilter(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := BuildOptions{Filter: filter}
+			tree, err := ResolveSupersedence(context.Background(), 4093105, opts)
+			if err != nil {
+				t.Fatalf("ResolveSupersedence error = %v", err)
+			}
+			list, err := LatestKBList(context.Background(), []*SupersedenceTree{tree}, opts)
+			if err != nil {
+				t.Fatalf("LatestKBList error = %v", err)
+			}
+			kbs := list.KBs()
+			if len(kbs) != 1 || kbs[0].No() != 4284819 {
+				t.Fatalf("KBs() = %v, want [4284819]", kbs)
+			}
+			packages, filtered := []string{}, []string{}
+			for _, p := range kbs[0].PackageInfos {
+				packages = append(packages, p.UpdateID)
+				if len(p.Files) != 1 || p.Files[0].Architecture != "AMD64" {
+					t.Errorf("Files = %+v, want 1 AMD64 file", p.Files)
+				}
+			}
+			for _, f := range kbs[0].Filtered {
+				filtered = append(filtered, f.Package.UpdateID)
+			}
+			if !reflect.DeepEqual(packages, tt.wantPackages) || !reflect.DeepEqual(filtered, tt.wantFiltered) {
+				t.Errorf("PackageInfos = %v, Filtered = %v, want %v, %v", packages, filtered, tt.wantPackages, tt.wantFiltered)
+			}
+		})
+	}
+}
+
+// newTestDiamondTree : 各段の2つの更新プログラムが次の段の2つの更新プログラムに置き換えられる木(経路の数は 2^levels)
+// 最後の段は別の製品の更新プログラムにも置き換えられる
+func newTestDiamondTree(levels int) *SupersedenceTree {
+	newNode := func(id string, products string) *SupersedenceNode {
+		return &SupersedenceNode{Package: &PackageInfo{
+			UpdateID: id,
+			Title:    "Cumulative Update for Windows 10 for x64-based Systems (" + id + ")",
+			Products: products,
+		}}
+	}
+	tree := &SupersedenceTree{No: 1}
+	other := newNode("other", "Windows Server 2016")
+	prev := []*SupersedenceNode{newNode("0a", "Windows 10"), newNode("0b", "Windows 10")}
+	tree.Roots = prev
+	for i := 1; i <= levels; i++ {
+		next := []*SupersedenceNode{newNode(fmt.Sprintf("%da", i), "Windows 10"), newNode(fmt.Sprintf("%db", i), "Windows 10")}
+		for _, node := range prev {
+			node.SupersededBy = next
+		}
+		prev = next
+	}
+	for _, node := range prev {
+		node.SupersededBy = []*SupersedenceNode{other}
+	}
+	return tree
+}
+
+// TestSupersedenceDiamond : 複数の経路で辿れる更新プログラムも1回ずつ出力する(経路ごとに辿ると終わらない)
+func TestSupersedenceDiamond(t *testing.T) {
+	const levels = 40
+	tree := newTestDiamondTree(levels)
+	nodes := 2*(levels+1) + 1
+
+	if got := len(tree.Nodes()); got != nodes {
+		t.Errorf("len(Nodes()) = %d, want %d", got, nodes)
+	}
+	// 別の製品の更新プログラムは最新に含めない
+	want := []string{fmt.Sprintf("%da", levels), fmt.Sprintf("%db", levels)}
+	if got := updateIDs(tree.Leaves()); !reflect.DeepEqual(got, want) {
+		t.Errorf("Leaves() = %v, want %v", got, want)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := WriteSupersedenceCSV(buf, []*SupersedenceTree{tree}); err != nil {
+		t.Fatalf("WriteSupersedenceCSV error = %v", err)
+	}
+	records, err := csv.NewReader(buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != nodes+1 {
+		t.Fatalf("CSV rows = %d, want %d", len(records)-1, nodes)
+	}
+	header := records[0]
+	row := records[3]
+	if row[csvColumn(t, header, "UpdateID")] != "1a" || row[csvColumn(t, header, "Depth")] != "1" || row[csvColumn(t, header, "ParentUpdateIDs")] != "0a; 0b" {
+		t.Errorf("CSV row = %v", row)
+	}
+	latest := csvColumn(t, header, "Latest")
+	if records[nodes-2][latest] != "true" || records[nodes][latest] != "false" {
+		t.Errorf("CSV Latest = [%s %s], want [true false]", records[nodes-2][latest], records[nodes][latest])
+	}
+
+	buf.Reset()
+	if err := WriteSupersedenceJSON(buf, []*SupersedenceTree{tree}); err != nil {
+		t.Fatalf("WriteSupersedenceJSON error = %v", err)
+	}
+	values := []supersedenceJSON{}
+	if err := json.Unmarshal(buf.Bytes(), &values); err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || len(values[0].Updates) != nodes || !reflect.DeepEqual(values[0].Roots, []string{"0a", "0b"}) {
+		t.Fatalf("JSON = %+v", values)
+	}
+	if u := values[0].Updates[2]; u.UpdateID != "1a" || !reflect.DeepEqual(u.ParentUpdateIDs, []string{"0a", "0b"}) || !reflect.DeepEqual(u.SupersededBy, []string{"2a", "2b"}) {
+		t.Errorf("JSON update = %+v", u)
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-ini/ini"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/tsubasaxZZZ/wutools/common"
+)
+
+var (
+	db *sql.DB
+	// デーモンモードでの KB 情報の取得オプション(config.ini)
+	sessionOptions kb.BuildOptions
+	// 同時に処理するセッション(KB)の数(config.ini)
+	daemonWorkers int
+	// ワーカーの識別子とセッションのリースの期間(config.ini)
+	daemonWorkerID string
+	daemonLease    time.Duration
+	// 停止時に処理中のセッションの終了を待つ時間(config.ini)
+	daemonShutdownGrace time.Duration
+)
+
+// runDaemon : daemon サブコマンド。データベースに登録されたセッションを処理し続ける
+func runDaemon(args []string) int {
+	fs := newFlagSet("daemon", "", "Process sessions registered from the web page(database worker).")
+	configPath := fs.String("config", "config.ini", "Specific config file of database and daemon")
+	catalog := addCatalogFlags(fs)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() > 0 {
+		return usageError(fs, "daemon takes no arguments")
+	}
+	catalog.apply()
+	// SIGTERM(docker stop)、SIGINT(Ctrl+C)で停止する
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	return daemonize(ctx, *configPath)
+}
+
+func connectDB(configPath string) error {
+	// 設定ファイル読み込み
+	cfg, err := ini.Load(configPath)
+	if err != nil {
+		log.Fatalf("Fail to read file: %v", err)
+		return err
+	}
+	//user:password@tcp(host:port)/dbname
+	connectionString := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true",
+		cfg.Section("").Key("DATABASE_USERNAME").String(),
+		cfg.Section("").Key("DATABASE_PASSWORD").String(),
+		cfg.Section("").Key("DATABASE_SERVER").String(),
+		cfg.Section("").Key("DATABASE_PORT").String(),
+		cfg.Section("").Key("DATABASE_NAME").String(),
+	)
+	sessionOptions.Details = cfg.Section("").Key("FETCH_DETAILS").MustBool(false)
+	sessionOptions.Article = cfg.Section("").Key("FETCH_ARTICLE").MustBool(false)
+	kb.ProgressInterval = time.Duration(cfg.Section("").Key("PROGRESS_INTERVAL_SECONDS").MustInt(5)) * time.Second
+	daemonWorkers = cfg.Section("").Key("WORKERS").MustInt(10)
+	if daemonWorkers < 1 {
+		daemonWorkers = 1
+	}
+	daemonWorkerID = cfg.Section("").Key("WORKER_ID").MustString(kb.DefaultWorkerID())
+	daemonLease = time.Duration(cfg.Section("").Key("LEASE_SECONDS").MustInt(300)) * time.Second
+	if daemonLease < 30*time.Second {
+		daemonLease = 30 * time.Second
+	}
+	daemonShutdownGrace = time.Duration(cfg.Section("").Key("SHUTDOWN_GRACE_SECONDS").MustInt(60)) * time.Second
+	kb.SessionRetryPolicy.MaxAttempts = cfg.Section("").Key("RETRY_MAX_ATTEMPTS").MustInt(5)
+	kb.SessionRetryPolicy.BaseDelay = time.Duration(cfg.Section("").Key("RETRY_BASE_SECONDS").MustInt(60)) * time.Second
+	kb.SessionRetryPolicy.MaxDelay = time.Duration(cfg.Section("").Key("RETRY_MAX_SECONDS").MustInt(3600)) * time.Second
+	// DB 接続
+	log.Printf("Connect mysql: %s", connectionString)
+	db, err = sql.Open("mysql", connectionString)
+	return err
+
+}
+
+// daemonize : ctx が終了(シグナルを受信)するまでセッションを処理し続ける
+// 停止時は新しいセッションを取得せず、処理中のセッションの終了を猶予期間まで待つ。猶予期間を過ぎた場合は中断してデータベースに記録する
+func daemonize(ctx context.Context, configPath string) int {
+	err := connectDB(configPath)
+	if err != nil {
+		log.Printf("Connect database error: %v", err)
+		return exitFailure
+	}
+	defer db.Close()
+
+	pool := newWorkerPool(daemonWorkers)
+	log.Printf("Start daemon: worker=[%s], workers=[%d], lease=[%s], shutdown-grace=[%s]", daemonWorkerID, daemonWorkers, daemonLease, daemonShutdownGrace)
+
+	// 停止するまでループ。処理中のセッションの終了は待たず、周期ごとに空いているワーカーにセッションを渡す
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for ctx.Err() == nil {
+		pollSessions(ctx, pool)
+
+		// 処理中のセッションのディレクトリは削除しない(cleanup で busy を確認する)
+		if err := cleanup(pool); err != nil {
+			log.Printf("Cleanup error: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+	}
+
+	log.Printf("Shutdown daemon: in-flight=[%d], grace=[%s]", pool.inFlightCount(), daemonShutdownGrace)
+	if !pool.shutdown(daemonShutdownGrace) {
+		log.Println("Shutdown complete: some sessions were interrupted.")
+		return exitInterrupted
+	}
+	log.Println("Shutdown complete.")
+	return exitOK
+}
+
+// pollSessions : 登録済みのセッションと、中断したセッション、再試行の日時になったエラーのセッションを取得してワーカーに渡す
+// データベースのエラーの場合は次の周期で再度取得する
+func pollSessions(ctx context.Context, pool *workerPool) {
+	// 登録済み状態のセッション
+	sessions, err := registeredSessions()
+	if err != nil {
+		log.Printf("Query session error: %v", err)
+		return
+	}
+	// デーモンの停止で中断したセッション
+	interrupted, err := interruptedSessions()
+	if err != nil {
+		log.Printf("Query interrupted session error: %v", err)
+		return
+	}
+	// 処理中のまま中断したセッション(デーモンの異常終了など)も取得し、続きから処理する
+	stale, err := staleSessions()
+	if err != nil {
+		log.Printf("Query stale session error: %v", err)
+		return
+	}
+	// エラーになったセッションのうち、再試行の日時になったもの
+	retry, err := retrySessions()
+	if err != nil {
+		log.Printf("Query retry session error: %v", err)
+		return
+	}
+	if len(interrupted)+len(stale)+len(retry) > 0 {
+		log.Printf("Found sessions to resume: interrupted=[%d], stale=[%d], retry=[%d]", len(interrupted), len(stale), len(retry))
+	}
+	sessions = append(sessions, interrupted...)
+	sessions = append(sessions, stale...)
+	sessions = append(sessions, retry...)
+
+	// KB単位でワーカーに渡す。処理中のセッションは渡さない。空いているワーカーがなければ次の周期に渡す
+	for _, session := range sessions {
+		if ctx.Err() != nil {
+			return
+		}
+		switch err := pool.submit(session); {
+		case errors.Is(err, errSessionInFlight):
+			log.Printf("Session is in progress. skip.. : id=[%s], kbno=[%d]", session.ID.String, session.Kbno)
+		case errors.Is(err, errNoIdleWorker):
+			log.Printf("All workers are busy. wait for next poll.. : in-flight=[%d]", pool.inFlightCount())
+			return
+		}
+	}
+}
+
+// registeredSessions : 登録済み状態のセッションを取得する
+func registeredSessions() ([]kb.Session, error) {
+	log.Println("Query session table.")
+	return querySessions("`status` & ? = 1", kb.StatusRegistered)
+}
+
+// interruptedSessions : デーモンの停止で中断したセッションを取得する
+func interruptedSessions() ([]kb.Session, error) {
+	return querySessions("`status` & ? != 0 AND (lease_expires_utc IS NULL OR lease_expires_utc < UTC_TIMESTAMP())", kb.StatusInterrupted)
+}
+
+// staleSessions : 処理中(段階の間を含む)の状態のまま、リースが期限切れになったセッションを取得する
+func staleSessions() ([]kb.Session, error) {
+	placeholders := make([]string, 0, len(kb.InProgressStatuses))
+	args := []interface{}{}
+	for _, status := range kb.InProgressStatuses {
+		placeholders = append(placeholders, "?")
+		args = append(args, status)
+	}
+	args = append(args, kb.StautsMetadataComplete, time.Now().Add(-daemonLease))
+	return querySessions("(`status` IN ("+strings.Join(placeholders, ",")+") OR "+kb.DownloadPendingCondition+") AND "+kb.StaleCondition, args...)
+}
+
+// retrySessions : エラーになったセッションのうち、再試行の日時になったものを取得する
+func retrySessions() ([]kb.Session, error) {
+	return querySessions(kb.RetryCondition, kb.StatusError)
+}
+
+// querySessions : 条件を満たすセッションを取得する
+func querySessions(condition string, args ...interface{}) ([]kb.Session, error) {
+	rows, err := db.Query(
+		"SELECT id,kbno,sakey, saname, filter, create_utc_date,update_utc_date,status,attempt_count FROM session WHERE "+condition,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// 行スキャン
+	var sessions []kb.Session
+	log.Println("Start scan rows.")
+	for rows.Next() {
+		var session kb.Session
+		session.Db = db
+		session.Options = sessionOptions
+		err := rows.Scan(
+			&(session.ID),
+			&(session.Kbno),
+			&(session.Sakey),
+			&(session.Saname),
+			&(session.Filter),
+			&(session.CreateDate),
+			&(session.UpdateDate),
+			&(session.Status),
+			&(session.Attempts),
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// sessionKey : セッション(KB)の識別子
+type sessionKey struct {
+	id   string
+	kbno int
+}
+
+// workerPool : 決まった数のワーカーでセッションを処理する
+// 処理中のセッションを記録し、同じセッションを同時に2回処理しない
+type workerPool struct {
+	queue   chan kb.Session
+	workers sync.WaitGroup
+	// ctx : ワーカーが処理するセッションの context。停止の猶予期間を過ぎた場合に cancel で中断する
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu          sync.Mutex
+	inFlight    map[sessionKey]bool
+	interrupted int
+}
+
+// newWorkerPool : size 個のワーカーを起動する
+func newWorkerPool(size int) *workerPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	pool := &workerPool{queue: make(chan kb.Session), ctx: ctx, cancel: cancel, inFlight: map[sessionKey]bool{}}
+	for i := 0; i < size; i++ {
+		pool.workers.Add(1)
+		go pool.work(i + 1)
+	}
+	return pool
+}
+
+// work : キューのセッションを順に処理する
+func (pool *workerPool) work(worker int) {
+	defer pool.workers.Done()
+	for session := range pool.queue {
+		log.Printf("Worker start session: worker=[%d], id=[%s], kbno=[%d]", worker, session.ID.String, session.Kbno)
+		err := processSession(pool.ctx, session)
+		pool.mu.Lock()
+		delete(pool.inFlight, sessionKey{session.ID.String, session.Kbno})
+		if errors.Is(err, kb.ErrInterrupted) {
+			pool.interrupted++
+		}
+		pool.mu.Unlock()
+	}
+}
+
+// processSession : セッションを取得(Claim)して処理する。他のデーモンが先に取得した場合は処理しない
+// 中断したセッションは中断した段階の状態で取得し、完了した段階の続きから処理する
+// 処理中はリースを延長し続け、リースを失った場合は処理を中断する
+// 処理の結果(エラー、次の再試行の日時)はセッションに記録する
+func processSession(ctx context.Context, session kb.Session) error {
+	claim := session.Claim
+	switch {
+	case session.Status&kb.StatusInterrupted != 0:
+		log.Printf("Resume interrupted session: id=[%s], kbno=[%d], status=[%d]", session.ID.String, session.Kbno, session.Status)
+		claim = session.ClaimInterrupted
+	case session.Status == kb.StatusError:
+		log.Printf("Retry failed session: id=[%s], kbno=[%d], attempt=[%d]", session.ID.String, session.Kbno, session.Attempts+1)
+		claim = session.ClaimRetry
+	case session.Status != kb.StatusRegistered:
+		log.Printf("Recover stale session: id=[%s], kbno=[%d], status=[%d], update=[%s]", session.ID.String, session.Kbno, session.Status, session.UpdateDate)
+		claim = session.ClaimStale
+	}
+	claimed, err := claim(daemonWorkerID, daemonLease)
+	if err != nil {
+		log.Printf("Claim session error: id=[%s], kbno=[%d], error=[%v]", session.ID.String, session.Kbno, err)
+		return err
+	}
+	if !claimed {
+		log.Printf("Session is claimed by other worker. skip.. : id=[%s], kbno=[%d]", session.ID.String, session.Kbno)
+		return nil
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	heartbeat := make(chan struct{})
+	go func() {
+		defer close(heartbeat)
+		session.Heartbeat(ctx, daemonLease, cancel)
+	}()
+	err = session.ProcessSession(ctx)
+	if err != nil {
+		log.Printf("ProcessSession error: id=[%s], kbno=[%d], error=[%v]", session.ID.String, session.Kbno, err)
+	}
+	session.RecordAttempt(err, kb.SessionRetryPolicy)
+	cancel(nil)
+	<-heartbeat
+	// 中断した場合もリースを解放し、他のデーモン(または再起動後のデーモン)がすぐに再開できるようにする
+	session.Release()
+	return err
+}
+
+var (
+	// errSessionInFlight : セッションが既に処理中
+	errSessionInFlight = errors.New("session is in flight")
+	// errNoIdleWorker : 全てのワーカーが処理中
+	errNoIdleWorker = errors.New("no idle worker")
+)
+
+// submit : セッションを空いているワーカーに渡す。ワーカーが空くのは待たない
+// 既に処理中のセッションの場合は errSessionInFlight、空いているワーカーがない場合は errNoIdleWorker を返す
+func (pool *workerPool) submit(session kb.Session) error {
+	key := sessionKey{session.ID.String, session.Kbno}
+	pool.mu.Lock()
+	if pool.inFlight[key] {
+		pool.mu.Unlock()
+		return errSessionInFlight
+	}
+	pool.inFlight[key] = true
+	pool.mu.Unlock()
+	select {
+	case pool.queue <- session:
+		return nil
+	default:
+		pool.mu.Lock()
+		delete(pool.inFlight, key)
+		pool.mu.Unlock()
+		return errNoIdleWorker
+	}
+}
+
+// busy : セッション ID のいずれかの KB が処理中かどうか
+func (pool *workerPool) busy(id string) bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for key := range pool.inFlight {
+		if key.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// inFlightCount : 処理中のセッションの数
+func (pool *workerPool) inFlightCount() int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return len(pool.inFlight)
+}
+
+// shutdown : ワーカーを停止する。処理中のセッションの終了を grace まで待ち、過ぎた場合は中断させて終了を待つ
+// 全てのセッションが中断せずに終了した場合は true
+func (pool *workerPool) shutdown(grace time.Duration) bool {
+	close(pool.queue)
+	done := make(chan struct{})
+	go func() {
+		pool.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(grace):
+		log.Printf("Shutdown grace period exceeded. interrupt sessions.. : in-flight=[%d]", pool.inFlightCount())
+		pool.cancel()
+		<-done
+	}
+	pool.cancel()
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return pool.interrupted == 0
+}
+
+// cleanup : 全ての KB のアップロードが完了したセッションのディレクトリを削除する。処理中のセッションは削除しない
+// データベースのエラーの場合は次の周期で再度実行する
+// ディレクトリはセッションを処理したデーモンにのみあるため、ディレクトリがこのデーモンにあるセッションのみを対象とする
+// (ワーカーの識別子は再起動で変わるため、worker_id では判断しない)
+func cleanup(pool *workerPool) error {
+	rows, err := db.Query(
+		"SELECT id,kbno,sakey, saname, create_utc_date,update_utc_date,status FROM session WHERE `status` & ? != ?",
+		kb.StatusCleanupComplete, kb.StatusCleanupComplete,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// 行スキャン
+	sessions := make(map[string][]kb.Session)
+	for rows.Next() {
+		var session kb.Session
+		session.Db = db
+		err := rows.Scan(
+			&(session.ID),
+			&(session.Kbno),
+			&(session.Sakey),
+			&(session.Saname),
+			&(session.CreateDate),
+			&(session.UpdateDate),
+			&(session.Status),
+		)
+		if err != nil {
+			return err
+		}
+		sessions[session.ID.String] = append(sessions[session.ID.String], session)
+	}
+	log.Printf("Start scan rows for cleanup.: cleanup session count=[%d]", len(sessions))
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, sessionList := range sessions {
+		if pool.busy(id) {
+			log.Printf("Session is in progress. skip cleanup.. : id=[%s]", id)
+			continue
+		}
+		canCleanup := true
+		// 全てのパッケージがアップロード完了していたら削除可能
+		for _, session := range sessionList {
+			log.Printf("Session status check.: id=[%s], status=[%d]", id, session.Status)
+			if session.Status != kb.StatusUploadComplete {
+				canCleanup = false
+			}
+		}
+		if canCleanup {
+			if _, err := os.Stat(id); os.IsNotExist(err) {
+				log.Printf("Session directory is not on this daemon. skip cleanup.. : id=[%s]", id)
+				continue
+			}
+			log.Printf("Start cleanup: id=[%s]", id)
+			err := os.RemoveAll(id)
+			if err != nil {
+				log.Printf("Cleanup error: id=[%s], error=[%v]", id, err.Error())
+				continue
+			}
+			for _, session := range sessionList {
+				session.ChangeStatus(kb.StatusCleanupComplete)
+			}
+			log.Printf("End cleanup: id=[%s]", id)
+		}
+	}
+	return nil
+}
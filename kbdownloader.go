@@ -1,202 +1,353 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"strconv"
 	"strings"
 	"time"
 
-	"github.com/go-ini/ini"
-
-	_ "github.com/go-sql-driver/mysql"
 	"github.com/tsubasaxZZZ/wutools/common"
 )
 
-var (
-	kbnoOpt     = flag.String("n", "", "Specific KB NO(if you want to multiple, separate comma)")
-	csvOpt      = flag.String("f", "", "(Not Implement)Specific CSV file")
-	metaonlyOpt = flag.Bool("metadata-only", false, "If you want to get only metadata, specific this option")
-	conOpt      = flag.Int("c", 10, "Specific max downloadconcurrent num(default:10)")
-	daemonOpt   = flag.Bool("d", false, "Daemon mode")
-	db          *sql.DB
+// 終了コード
+const (
+	// exitOK : 全て成功
+	exitOK = 0
+	// exitFailure : 全て失敗、または処理を開始できなかった
+	exitFailure = 1
+	// exitUsage : 引数の誤り
+	exitUsage = 2
+	// exitPartial : 一部の KB・ファイルが失敗
+	exitPartial = 3
+	// exitInterrupted : デーモンの停止時に、猶予期間内に終わらなかったセッションを中断した
+	exitInterrupted = 4
 )
 
+// command : サブコマンド
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+var commands = []command{
+	{"search", "Search the catalog by query and list updates", runSearch},
+	{"info", "Show metadata of KB(packages, files, details, supersedence)", runInfo},
+	{"download", "Download package files of KB", runDownload},
+	{"export", "Export metadata of KB to CSV", runExport},
+	{"verify", "Verify downloaded files against digests recorded in metadata CSV", runVerify},
+	{"daemon", "Process sessions registered from the web page(database worker)", runDaemon},
+}
+
 func main() {
-	// 引数のパース
-	flag.Parse()
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(exitUsage)
+	}
+	name := os.Args[1]
+	switch name {
+	case "help", "-h", "-help", "--help":
+		// help <サブコマンド> はサブコマンドのヘルプ
+		if len(os.Args) > 2 {
+			name = os.Args[2]
+			for _, cmd := range commands {
+				if cmd.name == name {
+					os.Exit(cmd.run([]string{"-h"}))
+				}
+			}
+		}
+		usage()
+		os.Exit(exitOK)
+	}
+	for _, cmd := range commands {
+		if cmd.name == name {
+			os.Exit(cmd.run(os.Args[2:]))
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", name)
+	usage()
+	os.Exit(exitUsage)
+}
 
-	if *daemonOpt {
-		daemonize()
-		return
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: kbdownloader <command> [options] [arguments]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.summary)
 	}
-	if *kbnoOpt == "" {
-		fmt.Println("You need specific KB no.(Please read --help)")
-		return
+	fmt.Fprintf(os.Stderr, "\nRun \"kbdownloader <command> -h\" for options of each command.\n")
+	fmt.Fprintf(os.Stderr, "\nExit codes:\n  %d  success\n  %d  failure\n  %d  invalid arguments\n  %d  partial failure(some KBs or files failed)\n",
+		exitOK, exitFailure, exitUsage, exitPartial)
+}
+
+// newFlagSet : サブコマンドのオプション。args はヘルプに表示する引数の書式
+func newFlagSet(name string, args string, description string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: kbdownloader %s [options] %s\n\n%s\n\nOptions:\n", name, args, description)
+		fs.PrintDefaults()
 	}
-	strKbno := strings.Split(*kbnoOpt, ",")
-	kbno := []int{}
-	for _, v := range strKbno {
-		si, err := strconv.Atoi(v)
-		if err != nil {
-			fmt.Print(err)
-			return
+	return fs
+}
+
+// parseFlags : オプションを解析する。ok が false の場合は code で終了する
+func parseFlags(fs *flag.FlagSet, args []string) (code int, ok bool) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK, false
 		}
-		kbno = append(kbno, si)
+		return exitUsage, false
+	}
+	return exitOK, true
+}
+
+// usageError : 引数の誤りを表示する
+func usageError(fs *flag.FlagSet, format string, a ...interface{}) int {
+	fmt.Fprintf(fs.Output(), format+"\n\n", a...)
+	fs.Usage()
+	return exitUsage
+}
+
+// exitStatus : 成功数と失敗数から終了コードを決める
+func exitStatus(succeeded int, failed int) int {
+	switch {
+	case failed == 0:
+		return exitOK
+	case succeeded == 0:
+		return exitFailure
+	default:
+		return exitPartial
 	}
-	log.Printf("Target KB no:%v", kbno)
+}
 
-	// KB のリストの生成
-	kbList := kb.NewKBList(kbno, *conOpt)
+// catalogFlags : カタログへのアクセスの共通オプション
+type catalogFlags struct {
+	retry      *int
+	timeout    *time.Duration
+	pkgTimeout *time.Duration
+	catalogURL *string
+	supportURL *string
+}
 
-	log.Println(*kbList)
+func addCatalogFlags(fs *flag.FlagSet) *catalogFlags {
+	return &catalogFlags{
+		retry:      fs.Int("retry", kb.DefaultRetryPolicy.MaxAttempts, "Specific max attempts of catalog request and download"),
+		timeout:    fs.Duration("timeout", kb.DefaultRetryPolicy.RequestTimeout, "Specific timeout of each catalog request(for download, until response header)"),
+		pkgTimeout: fs.Duration("package-timeout", kb.DefaultRetryPolicy.PackageTimeout, "Specific deadline of each package(metadata and download)"),
+		catalogURL: fs.String("catalog-url", kb.DefaultCatalogBaseURL, "Specific base URL of Windows Update Catalog"),
+		supportURL: fs.String("support-url", kb.DefaultSupportBaseURL, "Specific base URL of support site for KB articles"),
+	}
+}
 
-	// CSV へメタデータを出力
-	kbList.ExportMetadataToCSV()
+// apply : 再試行ポリシーとカタログ、サポートサイトの URL を設定する
+func (f *catalogFlags) apply() {
+	kb.DefaultRetryPolicy.MaxAttempts = *f.retry
+	kb.DefaultRetryPolicy.RequestTimeout = *f.timeout
+	kb.DefaultRetryPolicy.PackageTimeout = *f.pkgTimeout
+	kb.DefaultCatalog = kb.NewCatalogClient(*f.catalogURL, nil)
+	kb.DefaultArticles = kb.NewArticleCache(kb.NewArticleClient(*f.supportURL, nil))
+}
 
-	// メタデータのみ取得のオプションがない場合にパッケージをダウンロード
-	if !*metaonlyOpt {
-		kbList.DownloadAllKB(*conOpt)
+// targetFlags : 対象の KB の指定と取得オプション
+type targetFlags struct {
+	kbno      *string
+	csv       *string
+	csvColumn *string
+	csvHeader *string
+	queries   queryFlag
+	filter    *string
+	details   *bool
+	article   *bool
+	con       *int
+}
+
+func addTargetFlags(fs *flag.FlagSet) *targetFlags {
+	t := &targetFlags{
+		kbno:      fs.String("n", "", "Specific KB NO(if you want to multiple, separate comma)"),
+		csv:       fs.String("f", "", "Specific CSV file of KB NO(columns: KB, and optional Product, Architecture, Language)"),
+		csvColumn: fs.String("f-column", "", "Specific KB NO column of CSV file by name or 1-based index(default: \"KB\" column or first column)"),
+		csvHeader: fs.String("f-header", "auto", "Specific whether CSV file has header row(auto, yes, no)"),
+		filter:    fs.String("filter", "", "Specific filter of packages(e.g. \"arch=x64; lang=en-us,ja-jp; product=Windows Server 2019; title!~Preview\")"),
+		details:   fs.Bool("details", false, "Get update details(supersedence, MSRC severity, restart behavior etc.) from catalog"),
+		article:   fs.Bool("article", false, "Get title, release date and applies to of KB article from support site"),
+		con:       fs.Int("c", 10, "Specific max concurrent num of catalog requests and downloads"),
 	}
+	fs.Var(&t.queries, "q", "Specific search query of catalog instead of KB NO(e.g. \"Cumulative Update for Windows Server 2016\"). Can be specified multiple times")
+	return t
 }
 
-func connectDB() error {
-	// 設定ファイル読み込み
-	cfg, err := ini.Load("config.ini")
-	if err != nil {
-		log.Fatalf("Fail to read file: %v", err)
-		return err
+// csvFlags : メタデータの CSV の出力オプション
+type csvFlags struct {
+	columns *string
+	excel   *bool
+}
+
+func addCSVFlags(fs *flag.FlagSet) *csvFlags {
+	return &csvFlags{
+		columns: fs.String("columns", "", "Specific columns of metadata CSV and their order, separated by comma(default: "+strings.Join(kb.DefaultMetadataColumns, ",")+")\nAvailable: "+strings.Join(kb.MetadataColumnNames(), ",")),
+		excel:   fs.Bool("excel", false, "Write metadata CSV for Excel(UTF-8 with BOM, CRLF)"),
 	}
-	//user:password@tcp(host:port)/dbname
-	connectionString := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true",
-		cfg.Section("").Key("DATABASE_USERNAME").String(),
-		cfg.Section("").Key("DATABASE_PASSWORD").String(),
-		cfg.Section("").Key("DATABASE_SERVER").String(),
-		cfg.Section("").Key("DATABASE_PORT").String(),
-		cfg.Section("").Key("DATABASE_NAME").String(),
-	)
-	// DB 接続
-	log.Printf("Connect mysql: %s", connectionString)
-	db, err = sql.Open("mysql", connectionString)
-	return err
-
-}
-func daemonize() {
-	err := connectDB()
+}
+
+// options : CSV の出力オプション
+func (c *csvFlags) options(format kb.ExportFormat) (kb.ExportOptions, error) {
+	columns, err := kb.ParseMetadataColumns(*c.columns)
 	if err != nil {
-		panic(err.Error())
-	}
-	defer db.Close()
-
-	//無限ループ
-	for {
-		// session テーブルのクエリ
-		// 登録済み状態のもののみ取得
-		log.Println("Query session table.")
-		rows, err := db.Query(
-			"SELECT id,kbno,sakey, saname, create_utc_date,update_utc_date,status FROM session WHERE `status` & ? = 1",
-			kb.StatusRegistered,
-		)
+		return kb.ExportOptions{}, err
+	}
+	return kb.ExportOptions{Format: format, Columns: columns, Excel: *c.excel}, nil
+}
+
+// queryFlag : 複数回指定できる検索語のオプション
+type queryFlag []string
+
+func (q *queryFlag) String() string {
+	return strings.Join(*q, "; ")
+}
+
+func (q *queryFlag) Set(v string) error {
+	if strings.TrimSpace(v) == "" {
+		return fmt.Errorf("empty search query")
+	}
+	*q = append(*q, v)
+	return nil
+}
+
+// specs : -n、-f と引数で指定された KB 番号
+func (t *targetFlags) specs(args []string) ([]kb.KBSpec, error) {
+	nos := args
+	if *t.kbno != "" {
+		nos = append(strings.Split(*t.kbno, ","), nos...)
+	}
+	specs := []kb.KBSpec{}
+	for _, v := range nos {
+		no, err := kb.ParseKBNo(v)
 		if err != nil {
-			log.Fatal(err.Error())
-		}
-		defer rows.Close()
-
-		// 行スキャン
-		var sessions []kb.Session
-		log.Println("Start scan rows.")
-		for rows.Next() {
-			var session kb.Session
-			session.Db = db
-			err := rows.Scan(
-				&(session.ID),
-				&(session.Kbno),
-				&(session.Sakey),
-				&(session.Saname),
-				&(session.CreateDate),
-				&(session.UpdateDate),
-				&(session.Status),
-			)
-			if err != nil {
-				log.Fatal(err.Error())
-			}
-			sessions = append(sessions, session)
-		}
-		if err := rows.Err(); err != nil {
-			log.Panic(err.Error())
+			return nil, err
 		}
+		specs = append(specs, kb.KBSpec{No: no})
+	}
 
-		// KB単位で処理開始
-		semaphore := make(chan int, 10)
-		for _, session := range sessions {
-			semaphore <- 1
-			go session.ProcessSession()
-			<-semaphore
+	// -f で指定された CSV の KB 番号
+	if *t.csv != "" {
+		csvSpecs, err := readCSV(*t.csv, *t.csvColumn, *t.csvHeader)
+		if err != nil {
+			return nil, err
 		}
+		specs = kb.MergeKBSpecs(specs, csvSpecs)
+	}
+	return specs, nil
+}
 
-		cleanup()
-		time.Sleep(10 * time.Second)
+// options : KB 情報の取得オプション
+func (t *targetFlags) options() (kb.BuildOptions, error) {
+	filter, err := kb.ParseFilter(*t.filter)
+	if err != nil {
+		return kb.BuildOptions{}, err
 	}
+	return kb.BuildOptions{Details: *t.details, Filter: filter, Article: *t.article}, nil
 }
 
-func cleanup() {
-	rows, err := db.Query(
-		"SELECT id,kbno,sakey, saname, create_utc_date,update_utc_date,status FROM session WHERE `status` & ? != ?",
-		kb.StatusCleanupComplete, kb.StatusCleanupComplete,
-	)
+// parse : 対象の KB の指定を検証する。誤りがある場合は ok が false
+func (t *targetFlags) parse(fs *flag.FlagSet) (specs []kb.KBSpec, opts kb.BuildOptions, code int, ok bool) {
+	if len(t.queries) > 0 && (*t.kbno != "" || *t.csv != "" || fs.NArg() > 0) {
+		return nil, opts, usageError(fs, "Search query(-q) can not be specified with KB no(-n, arguments) or CSV file(-f)."), false
+	}
+	specs, err := t.specs(fs.Args())
 	if err != nil {
-		log.Fatal(err.Error())
-	}
-	defer rows.Close()
-
-	// 行スキャン
-	sessions := make(map[string][]kb.Session)
-	for rows.Next() {
-		var session kb.Session
-		session.Db = db
-		err := rows.Scan(
-			&(session.ID),
-			&(session.Kbno),
-			&(session.Sakey),
-			&(session.Saname),
-			&(session.CreateDate),
-			&(session.UpdateDate),
-			&(session.Status),
-		)
-		if err != nil {
-			log.Fatal(err.Error())
+		return nil, opts, usageError(fs, "%v", err), false
+	}
+	if len(specs) == 0 && len(t.queries) == 0 {
+		return nil, opts, usageError(fs, "You need specific KB no, CSV file or search query."), false
+	}
+	opts, err = t.options()
+	if err != nil {
+		return nil, opts, usageError(fs, "%v", err), false
+	}
+	return specs, opts, exitOK, true
+}
+
+// buildList : KB のリストを生成する。取得に失敗した KB はログに出力する
+func (t *targetFlags) buildList(ctx context.Context, specs []kb.KBSpec, opts kb.BuildOptions) *kb.KBList {
+	var kbList *kb.KBList
+	if len(t.queries) > 0 {
+		log.Printf("Target search query:%q", []string(t.queries))
+		kbList, _ = kb.NewKBListFromQueries(ctx, t.queries, *t.con, opts)
+	} else {
+		log.Printf("Target KB no:%v", specs)
+		kbList, _ = kb.NewKBList(ctx, specs, *t.con, opts)
+	}
+	for _, result := range kbList.Results() {
+		if result.Err != nil {
+			log.Printf("KB could not be got: kb=[%d], query=[%s], error=[%v]", result.No, result.Query, result.Err)
+			continue
 		}
-		sessions[session.ID.String] = append(sessions[session.ID.String], session)
+		log.Printf("KB: kb=[%d], query=[%s], hits=[%d], packages=[%d], filtered=[%d]", result.No, result.Query, result.KB.Hits(), len(result.KB.PackageInfos), len(result.KB.Filtered))
 	}
-	log.Printf("Start scan rows for cleanup.: cleanup session count=[%d]", len(sessions))
-	if err := rows.Err(); err != nil {
-		log.Panic(err.Error())
+	return kbList
+}
+
+// writeOutput : path のファイルに出力する。"-" の場合は標準出力
+func writeOutput(path string, write func(w io.Writer) error) error {
+	if path == "-" {
+		return write(os.Stdout)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := write(file); err != nil {
+		return err
 	}
+	return file.Close()
+}
 
-	for id, sessionList := range sessions {
-		canCleanup := true
-		// 全てのパッケージがアップロード完了していたら削除可能
-		for _, session := range sessionList {
-			log.Printf("Session status check.: id=[%s], status=[%d]", id, session.Status)
-			if session.Status != kb.StatusUploadComplete {
-				canCleanup = false
-			}
+// isTerminal : f が端末かどうか(進捗の表示に使用する)
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// readCSV : CSV ファイルから KB 番号と絞り込み条件を読み込む
+// 不正な行があってもエラーにしない。ファイル・ヘッダ・オプションの誤り、または正常な行がない場合はエラー
+func readCSV(path string, column string, header string) ([]kb.KBSpec, error) {
+	opt := kb.CSVOption{KBColumn: column}
+	switch strings.ToLower(header) {
+	case "auto":
+		opt.Header = kb.HeaderAuto
+	case "yes":
+		opt.Header = kb.HeaderPresent
+	case "no":
+		opt.Header = kb.HeaderAbsent
+	default:
+		return nil, fmt.Errorf("invalid -f-header value: %s", header)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// 不正な行は行番号を出力して読み飛ばし、正常な行のみ処理する
+	specs, err := kb.ReadKBSpecsFromCSV(file, opt)
+	var csvErr *kb.CSVError
+	if errors.As(err, &csvErr) {
+		for _, row := range csvErr.Rows {
+			log.Printf("Malformed CSV row. skip.. : file=[%s], %v", path, row)
 		}
-		if canCleanup {
-			log.Printf("Start cleanup: id=[%s]", id)
-			err := os.RemoveAll(id)
-			if err != nil {
-				log.Printf("Cleanup error: id=[%s], error=[%v]", id, err.Error())
-				continue
-			}
-			for _, session := range sessionList {
-				session.ChangeStatus(kb.StatusCleanupComplete)
-			}
-			log.Printf("End cleanup: id=[%s]", id)
+		if len(specs) == 0 {
+			return nil, fmt.Errorf("no valid row in CSV: file=[%s]: %w", path, err)
 		}
+		return specs, nil
 	}
-
+	if err != nil {
+		return nil, err
+	}
+	return specs, nil
 }
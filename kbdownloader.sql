@@ -34,7 +34,27 @@ CREATE TABLE IF NOT EXISTS `package` (
   `architecture` varchar(16) DEFAULT NULL,
   `fileName` varchar(1024) DEFAULT NULL,
   `language` varchar(16) DEFAULT NULL,
-  `fileSize` int(11) DEFAULT NULL,
+  `fileSize` bigint(20) DEFAULT NULL,
+  `digest` varchar(128) DEFAULT NULL,
+  `products` varchar(1024) DEFAULT NULL,
+  `classification` varchar(256) DEFAULT NULL,
+  `last_updated` date DEFAULT NULL,
+  `version` varchar(64) DEFAULT NULL,
+  `catalog_size` bigint(20) DEFAULT NULL,
+  `msrc_number` varchar(64) DEFAULT NULL,
+  `msrc_severity` varchar(64) DEFAULT NULL,
+  `reboot_behavior` varchar(128) DEFAULT NULL,
+  `requests_user_input` tinyint(1) DEFAULT NULL,
+  `uninstallable` tinyint(1) DEFAULT NULL,
+  `support_url` varchar(1024) DEFAULT NULL,
+  `supersedes` text DEFAULT NULL,
+  `superseded_by` text DEFAULT NULL,
+  `filter_reason` varchar(1024) DEFAULT NULL,
+  `downloaded_bytes` bigint(20) DEFAULT NULL,
+  `uploaded_bytes` bigint(20) DEFAULT NULL,
+  `attempt_count` int(11) NOT NULL DEFAULT 0,
+  `last_error` text DEFAULT NULL,
+  `next_attempt_utc` datetime DEFAULT NULL,
   `create_utc_date` datetime DEFAULT NULL,
   `update_utc_date` datetime DEFAULT NULL,
   `status` int(11) NOT NULL,
@@ -54,6 +74,15 @@ CREATE TABLE IF NOT EXISTS `session` (
   `kbno` int(11) NOT NULL,
   `saname` varchar(256) DEFAULT NULL,
   `sakey` varchar(256) DEFAULT NULL,
+  `filter` varchar(1024) DEFAULT NULL,
+  `title` varchar(1024) DEFAULT NULL,
+  `release_date` date DEFAULT NULL,
+  `applies_to` text DEFAULT NULL,
+  `worker_id` varchar(256) DEFAULT NULL,
+  `lease_expires_utc` datetime DEFAULT NULL,
+  `attempt_count` int(11) NOT NULL DEFAULT 0,
+  `last_error` text DEFAULT NULL,
+  `next_attempt_utc` datetime DEFAULT NULL,
   `create_utc_date` datetime DEFAULT NULL,
   `update_utc_date` datetime DEFAULT NULL,
   `status` int(11) NOT NULL,
@@ -24,6 +24,10 @@ STATUS_DOWNLOADSKIP = 0x80
 STATUS_ERROR = 0x100
 # STATUS_CLEANUP_COMPLETE クリーンアップの完了
 STATUS_CLEANUP_COMPLETE = 0x200
+# STATUS_FILTERED 絞り込み条件で対象外
+STATUS_FILTERED = 0x400
+# STATUS_INTERRUPTED デーモンの停止による中断(中断した段階の状態と組み合わせて格納)
+STATUS_INTERRUPTED = 0x800
 
 class Session(db.Model):
     __tablename__ = 'session'
@@ -32,10 +36,33 @@ class Session(db.Model):
     packages = db.relationship('Package', backref='session', lazy=True)
     saname = db.Column(db.String(256))
     sakey = db.Column(db.String(256))
+    filter = db.Column(db.String(1024))
+    title = db.Column(db.String(1024))
+    release_date = db.Column(db.Date)
+    applies_to = db.Column(db.Text)
+    worker_id = db.Column(db.String(256))
+    lease_expires_utc = db.Column(db.DateTime)
+    attempt_count = db.Column(db.Integer, nullable=False, default=0)
+    last_error = db.Column(db.Text)
+    next_attempt_utc = db.Column(db.DateTime)
     create_utc_date = db.Column(db.DateTime, default=datetime.datetime.utcnow)
     update_utc_date = db.Column(db.DateTime, default=datetime.datetime.utcnow)
     status = db.Column(db.Integer, nullable=False)
 
+    def progress(self):
+        """ダウンロード中・アップロード中の進捗(%)。それ以外の状態の場合は None"""
+        if self.status == STATUS_DOWNLOADINPROGRESS:
+            column = 'downloaded_bytes'
+        elif self.status == STATUS_UPLOAD_INPROGRESS:
+            column = 'uploaded_bytes'
+        else:
+            return None
+        packages = [p for p in self.packages if p.kbno == self.kbno and p.status != STATUS_FILTERED and (p.fileSize or 0) > 0]
+        total = sum(p.fileSize for p in packages)
+        if total == 0:
+            return None
+        return min(100.0, sum(getattr(p, column) or 0 for p in packages) * 100.0 / total)
+
     def __repr__(self):
         return '<Session id={id} kbno={kbno!r}>'.format(
            id=self.id, kbno=self.kbno
@@ -51,11 +78,43 @@ class Package(db.Model):
     architecture = db.Column(db.String(16))
     fileName = db.Column(db.String(1024))
     language = db.Column(db.String(16))
-    fileSize = db.Column(db.Integer())
+    fileSize = db.Column(db.BigInteger)
+    digest = db.Column(db.String(128))
+    products = db.Column(db.String(1024))
+    classification = db.Column(db.String(256))
+    last_updated = db.Column(db.Date)
+    version = db.Column(db.String(64))
+    catalog_size = db.Column(db.BigInteger)
+    msrc_number = db.Column(db.String(64))
+    msrc_severity = db.Column(db.String(64))
+    reboot_behavior = db.Column(db.String(128))
+    requests_user_input = db.Column(db.Boolean)
+    uninstallable = db.Column(db.Boolean)
+    support_url = db.Column(db.String(1024))
+    supersedes = db.Column(db.Text)
+    superseded_by = db.Column(db.Text)
+    filter_reason = db.Column(db.String(1024))
+    downloaded_bytes = db.Column(db.BigInteger)
+    uploaded_bytes = db.Column(db.BigInteger)
+    attempt_count = db.Column(db.Integer, nullable=False, default=0)
+    last_error = db.Column(db.Text)
+    next_attempt_utc = db.Column(db.DateTime)
     create_utc_date = db.Column(db.DateTime, default=datetime.datetime.utcnow)
     update_utc_date = db.Column(db.DateTime, default=datetime.datetime.utcnow)
     status = db.Column(db.Integer, nullable=False)
 
+    def progress(self):
+        """ダウンロード中・アップロード中の進捗(%)。それ以外の状態の場合は None"""
+        if not self.fileSize or self.fileSize <= 0:
+            return None
+        if self.status == STATUS_DOWNLOADINPROGRESS:
+            transferred = self.downloaded_bytes
+        elif self.status == STATUS_UPLOAD_INPROGRESS:
+            transferred = self.uploaded_bytes
+        else:
+            return None
+        return min(100.0, (transferred or 0) * 100.0 / self.fileSize)
+
     def __repr__(self):
         return '<Package id={id} session_id={session_id}, kbno={kbno!r}>'.format(
         id=self.id, kbno=self.kbno, session_id=self.session_id